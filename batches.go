@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ReceivedBatch is a batch that a peer announced on a topic
+// The same batch can be announced many times, Times counts how often and ReceivedAt is the last time
+type ReceivedBatch struct {
+	CID        string
+	Topic      string
+	Peer       string
+	Count      int
+	Times      int
+	ReceivedAt time.Time
+}
+
+// String method for ReceivedBatch: "*time* *peer* on *topic*: *cid* with *count* messages (*times* times)"
+func (b ReceivedBatch) String() string {
+	return fmt.Sprintf("%s %s on %s: %s with %d messages (%d times)", b.ReceivedAt.Format(time.RFC3339), b.Peer, b.Topic, b.CID, b.Count, b.Times)
+}
+
+// NetworkHistory shows from whom the batches were received, and the last 20 received batches
+func NetworkHistory() {
+	batches, err := GetStore().ReceivedBatches(0)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(batches) == 0 {
+		fmt.Println("Nothing received yet, start the OLN listener to receive messages from the network")
+		return
+	}
+	ShowNetworkHistory(batches, 20)
+}
+
+// ShowNetworkHistory shows how many batches and messages every peer sent, followed by at most limit batches,
+// 0 shows all of them
+func ShowNetworkHistory(batches []ReceivedBatch, limit int) {
+	// The peers are shown in the order they last sent something
+	var peers []string
+	sentBatches := make(map[string]int)
+	sentMessages := make(map[string]int)
+	for _, b := range batches {
+		if _, ok := sentBatches[b.Peer]; !ok {
+			peers = append(peers, b.Peer)
+		}
+		sentBatches[b.Peer]++
+		sentMessages[b.Peer] += b.Count
+	}
+	fmt.Println("Received from", len(peers), "peers:")
+	for _, peer := range peers {
+		fmt.Println(" ", peer+":", sentBatches[peer], "batches with", sentMessages[peer], "messages")
+	}
+	if limit > 0 && len(batches) > limit {
+		batches = batches[:limit]
+	}
+	fmt.Println("Last received batches:")
+	for _, b := range batches {
+		fmt.Println(" ", b)
+	}
+}
+
+// RecordReceivedBatch remembers that the peer announced the batch on the topic, in the table "batches"
+// When the peer announced it before, only how often and when it was last announced are updated
+func RecordReceivedBatch(db *sql.DB, b ReceivedBatch) error {
+	_, err := db.Exec(`INSERT INTO batches(cid, topic, peer, count, times, received_at) VALUES(?, ?, ?, ?, 1, ?)
+		ON CONFLICT(cid, topic, peer) DO UPDATE SET times = times + 1, received_at = excluded.received_at`,
+		b.CID, b.Topic, b.Peer, b.Count, b.ReceivedAt.Unix())
+	return err
+}
+
+// GetReceivedBatches returns at most limit of the batches in the table "batches", the last received first, 0 returns all
+func GetReceivedBatches(db *sql.DB, limit int) ([]ReceivedBatch, error) {
+	// A negative LIMIT returns all rows
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := db.Query("SELECT cid, topic, peer, count, times, received_at FROM batches ORDER BY received_at DESC, rowid DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batches []ReceivedBatch
+	for rows.Next() {
+		var b ReceivedBatch
+		var received int64
+		if err := rows.Scan(&b.CID, &b.Topic, &b.Peer, &b.Count, &b.Times, &received); err != nil {
+			return batches, err
+		}
+		b.ReceivedAt = time.Unix(received, 0)
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Command is a subcommand of infodump that can be used without the interactive menu, e.g. from scripts
+// The name can consist of two words for commands that belong together, like "sync push" and "sync pull"
+type Command struct {
+	Name        string
+	Args        string
+	Description string
+	Run         func(args []string) error
+}
+
+// Commands lists all subcommands, it is filled in init because the help command refers to it
+var Commands []Command
+
+func init() {
+	Commands = []Command{
+		{"interactive", "", "Start the interactive menu", InteractiveCommand},
+		{"post", "[message]", "Write a message, read from standard input if not given", PostCommand},
+		{"read", "", "Show the messages in the database by importance", ReadCommand},
+		{"search", "<query>", "Search the messages in the database", SearchCommand},
+		{"sync push", "", "Publish the messages in the database to the network", SyncPushCommand},
+		{"sync pull", "<cid>", "Get the messages with the given CID from the network and save them", SyncPullCommand},
+		{"listen", "", "Listen for messages from the network and save them", ListenCommand},
+		{"daemon", "", "Keep listening, saving and republishing messages until stopped", DaemonCommand},
+		{"history", "", "Show the batches that were received from the network and from whom", HistoryCommand},
+		{"tags add", "<tag>...", "Follow tags", TagsAddCommand},
+		{"tags remove", "<tag>...", "Stop following tags", TagsRemoveCommand},
+		{"tags list", "", "Show the followed tags", TagsListCommand},
+		{"feeds add", "<name>...", "Follow the feeds with the given IPNS names", FeedsAddCommand},
+		{"feeds remove", "<name>...", "Stop following feeds", FeedsRemoveCommand},
+		{"feeds list", "", "Show the followed feeds", FeedsListCommand},
+		{"feeds publish", "", "Publish the feed of this node under its IPNS name", FeedsPublishCommand},
+		{"feeds pull", "", "Get the new messages of the followed feeds and save them", FeedsPullCommand},
+		{"save", "<stamp>...", "Save messages, so they are kept in the database and pinned", SaveCommand},
+		{"unsave", "<stamp>...", "Stop saving messages", UnsaveCommand},
+		{"pin", "", "Pin the saved and important messages on the IPFS node and unpin the others", PinCommand},
+		{"expire", "", "Remove the expired messages from the database", ExpireCommand},
+		{"trim", "", "Keep only the most important messages in the database, same as db trim", TrimCommand},
+		{"db trim", "", "Keep only the most important messages in the database", TrimCommand},
+		{"help", "", "Show this help", HelpCommand},
+	}
+}
+
+// RunCommand finds the command for the arguments and runs it with the rest of the arguments
+func RunCommand(args []string) error {
+	if len(args) == 0 {
+		return HelpCommand(nil)
+	}
+	// Try the two word commands first
+	if len(args) > 1 {
+		for _, c := range Commands {
+			if c.Name == args[0]+" "+args[1] {
+				return c.Run(args[2:])
+			}
+		}
+	}
+	for _, c := range Commands {
+		if c.Name == args[0] {
+			return c.Run(args[1:])
+		}
+	}
+	HelpCommand(nil)
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+// HelpCommand shows the available commands
+func HelpCommand(args []string) error {
+	fmt.Println("Usage: infodump <command> [flags] [arguments]")
+	fmt.Println("Without a command, the interactive menu is started")
+	fmt.Println()
+	for _, c := range Commands {
+		fmt.Printf("  %-30s %s\n", strings.TrimSpace(c.Name+" "+c.Args), c.Description)
+	}
+	fmt.Println()
+	fmt.Println("Use infodump <command> -h to see the flags of a command")
+	return nil
+}
+
+// commandFlags are the flags every command has: the IPFS gateway and the database path
+type commandFlags struct {
+	*flag.FlagSet
+	gateway  *string
+	database *string
+}
+
+// newFlags creates the flags for a command
+func newFlags(name string) commandFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	return commandFlags{
+		FlagSet:  fs,
+		gateway:  fs.String("gateway", IPFSGateway, "address of the IPFS API"),
+		database: fs.String("db", DatabasePath, "path of the database"),
+	}
+}
+
+// openDatabase opens the database given by the flags, upgrades it if needed and makes it the database to use
+func (f commandFlags) openDatabase() (*sql.DB, error) {
+	DatabasePath = *f.database
+	db, err := OpenDatabase(DatabasePath)
+	if err != nil {
+		return nil, err
+	}
+	DB = db
+	LoadLocalIdentity()
+	return db, nil
+}
+
+// connect makes the IPFS gateway given by the flags the one to use, after checking that it works
+func (f commandFlags) connect() error {
+	err := TestIPFSGateway(*f.gateway)
+	if err != nil {
+		return err
+	}
+	UseIPFSGateway(*f.gateway)
+	return nil
+}
+
+// InteractiveCommand starts the interactive menu
+func InteractiveCommand(args []string) error {
+	f := newFlags("interactive")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	DatabasePath = *f.database
+	Interactive(*f.gateway)
+	return nil
+}
+
+// PostCommand creates a message, saves it to the database and optionally publishes it
+func PostCommand(args []string) error {
+	f := newFlags("post")
+	difficulty := f.Int("difficulty", message.DefaultPolicy.MinLead, "number of leading zero bits of the proof of work")
+	timeout := f.Duration("timeout", time.Minute, "how long to search for the proof of work")
+	budget := f.Duration("budget", 0, "search this long and use the strongest proof of work found, instead of -difficulty")
+	reply := f.String("reply", "", "stamp of the message to reply to")
+	anonymous := f.Bool("anonymous", false, "don't sign the message, even if there is an identity")
+	publish := f.Bool("publish", false, "publish the message to the network right away")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	text := strings.Join(f.Args(), " ")
+	if text == "" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimSpace(string(b))
+	}
+	if text == "" {
+		return fmt.Errorf("no message given")
+	}
+	if *reply != "" && !message.IsStamp(*reply) {
+		return fmt.Errorf("%q is not the stamp of a message", *reply)
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	msg, err := PostMessage(text, PostOptions{
+		Parent:     *reply,
+		Sign:       !*anonymous,
+		Difficulty: *difficulty,
+		Timeout:    *timeout,
+		Budget:     *budget,
+	})
+	if err != nil {
+		return err
+	}
+	if err := InsertMessage(db, msg); err != nil {
+		return err
+	}
+	fmt.Println(msg.Stamp())
+	if *publish {
+		if err := f.connect(); err != nil {
+			return err
+		}
+		single := message.Messages{}
+		single.Add(msg)
+		_, err = PublishMessages(Network, SQLiteStore{db}, &single)
+		return err
+	}
+	return nil
+}
+
+// ReadCommand shows the messages in the database, most important first
+func ReadCommand(args []string) error {
+	f := newFlags("read")
+	limit := f.Int("n", 0, "show at most this many messages, 0 shows all")
+	tag := f.String("tag", "", "only show the messages with this tag, e.g. #golang or @someone")
+	author := f.String("author", "", "only show the messages by this author, the fingerprint of their key or anonymous")
+	since := f.Duration("since", 0, "only show the messages written in this last period, e.g. 24h, 0 shows all")
+	near := f.String("near", "", "only show the messages tagged with a place close to this geohash or latitude,longitude")
+	radius := f.Float64("radius", 10, "how many km from -near the place of a message can be")
+	origin := f.Bool("origin", false, "also show when and where each message was first seen")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	var center message.Point
+	if *near != "" {
+		var ok bool
+		center, ok = message.ParsePoint(*near)
+		if !ok {
+			return fmt.Errorf("%q is not a geohash or a latitude,longitude", *near)
+		}
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	filter := Filter{Tag: *tag, Author: *author}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	stored, err := SQLiteStore{db}.Query(filter)
+	if err != nil {
+		return err
+	}
+	if *near != "" {
+		stored = stored.Near(center, *radius)
+	}
+	msgs := stored.MessageList()
+	if *limit > 0 && len(msgs) > *limit {
+		msgs = msgs[:*limit]
+	}
+	for _, m := range msgs {
+		fmt.Println(m)
+		if *origin {
+			printOrigin(db, m)
+		}
+	}
+	return nil
+}
+
+// printOrigin shows when and where the message was first seen, if that is known
+func printOrigin(db *sql.DB, m *message.Message) {
+	seen, source, err := GetMessageOrigin(db, m.Stamp())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if source == "" {
+		fmt.Println("First seen: unknown")
+		return
+	}
+	fmt.Println("First seen", seen.Format(time.RFC3339), "from", source)
+}
+
+// SearchCommand shows the messages in the database that match the query
+func SearchCommand(args []string) error {
+	f := newFlags("search")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	msgs, err := SearchMessages(SQLiteStore{db}, strings.Join(f.Args(), " "))
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		fmt.Println(m)
+	}
+	return nil
+}
+
+// SyncPushCommand publishes the messages in the database to the network
+func SyncPushCommand(args []string) error {
+	f := newFlags("sync push")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	cid, err := PublishMessages(Network, SQLiteStore{db}, GetMessagesFromDatabase(db))
+	if err != nil {
+		return err
+	}
+	fmt.Println(cid)
+	return nil
+}
+
+// SyncPullCommand gets the messages of a CID from the network and saves the valid ones to the database
+func SyncPullCommand(args []string) error {
+	f := newFlags("sync pull")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 1 {
+		return fmt.Errorf("usage: infodump sync pull [flags] <cid>")
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	msgs, report, err := PullMessages(Network, f.Arg(0), GetMessagesFromDatabase(db))
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	fmt.Println("Saved", SaveMessages(SQLiteStore{db}, msgs, CIDSource(f.Arg(0))))
+	return nil
+}
+
+// ListenCommand listens for messages on "OLN" and the followed tags and saves them to the database
+// It stops after the timeout, or when it gets interrupted
+func ListenCommand(args []string) error {
+	f := newFlags("listen")
+	timeout := f.Duration("timeout", 0, "stop listening after this long, 0 listens until interrupted")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	// The messages in the database are known, so only the new ones are saved
+	known := GetMessagesFromDatabase(db)
+	show := func(topic string, msgs *message.Messages) *message.Messages {
+		msgs.Each(func(m *message.Message) {
+			fmt.Println("Received on", topic+":")
+			fmt.Println(m)
+		})
+		return msgs
+	}
+	store := SQLiteStore{db}
+	listeners := ListenForMessages(ctx, Network, store, known, saveBatches(&sync.Mutex{}, store, known, show, func(topic string, count int) {
+		fmt.Println("Saved", count, "new messages from", topic)
+	}))
+	fmt.Println("Listening, press Ctrl+C to stop")
+	<-ctx.Done()
+	listeners.Wait()
+	return nil
+}
+
+// HistoryCommand shows the batches that were received from the network, see ShowNetworkHistory
+func HistoryCommand(args []string) error {
+	f := newFlags("history")
+	limit := f.Int("n", 20, "show at most this many batches, 0 shows all")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	batches, err := SQLiteStore{db}.ReceivedBatches(0)
+	if err != nil {
+		return err
+	}
+	ShowNetworkHistory(batches, *limit)
+	return nil
+}
+
+// TagsAddCommand follows the given tags
+func TagsAddCommand(args []string) error {
+	return changeTags("tags add", args, Store.FollowTag)
+}
+
+// TagsRemoveCommand stops following the given tags
+func TagsRemoveCommand(args []string) error {
+	return changeTags("tags remove", args, Store.UnfollowTag)
+}
+
+// changeTags applies change to every tag, or feed, given in the arguments
+func changeTags(name string, args []string, change func(store Store, tag string) error) error {
+	f := newFlags(name)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	for _, tag := range f.Args() {
+		if err := change(SQLiteStore{db}, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TagsListCommand shows the followed tags, one per line
+func TagsListCommand(args []string) error {
+	f := newFlags("tags list")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	for _, tag := range GetFollowedTags(db) {
+		fmt.Println(tag)
+	}
+	return nil
+}
+
+// FeedsAddCommand follows the given feeds
+func FeedsAddCommand(args []string) error {
+	return changeTags("feeds add", args, Store.FollowFeed)
+}
+
+// FeedsRemoveCommand stops following the given feeds
+func FeedsRemoveCommand(args []string) error {
+	return changeTags("feeds remove", args, Store.UnfollowFeed)
+}
+
+// FeedsListCommand shows the followed feeds, one per line
+func FeedsListCommand(args []string) error {
+	f := newFlags("feeds list")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	for _, name := range GetFollowedFeeds(SQLiteStore{db}) {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// FeedsPublishCommand publishes the feed of this node and shows its name
+func FeedsPublishCommand(args []string) error {
+	f := newFlags("feeds publish")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	name, err := PublishFeed(Network, SQLiteStore{db})
+	if err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+// FeedsPullCommand gets the new messages of the followed feeds and saves them to the database
+func FeedsPullCommand(args []string) error {
+	f := newFlags("feeds pull")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	store := SQLiteStore{db}
+	known := GetMessagesFromDatabase(db)
+	saved, err := SaveNewMessages(store, known, PullFeeds(Network, store, known), SourceFeeds)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Saved", saved, "new messages")
+	return nil
+}
+
+// SaveCommand saves the given messages and pins them
+func SaveCommand(args []string) error {
+	return changeSaved("save", args, true)
+}
+
+// UnsaveCommand stops saving the given messages and unpins them, unless they are important enough to stay pinned
+func UnsaveCommand(args []string) error {
+	return changeSaved("unsave", args, false)
+}
+
+// changeSaved marks the messages with the stamps in the arguments as saved or not saved and updates the pins
+// Without an IPFS node the messages are still marked, the pins are updated the next time, see PinCommand
+func changeSaved(name string, args []string, saved bool) error {
+	f := newFlags(name)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	store := SQLiteStore{db}
+	for _, stamp := range f.Args() {
+		if err := store.SetSaved(stamp, saved); err != nil {
+			return err
+		}
+	}
+	if err := f.connect(); err != nil {
+		fmt.Println("Not updating the pins, the IPFS node is not available:", err)
+		fmt.Println("Run infodump pin once it is")
+		return nil
+	}
+	pinned, unpinned, err := SyncPins(Network, store)
+	fmt.Println("Pinned", pinned, "and unpinned", unpinned, "messages")
+	return err
+}
+
+// PinCommand makes the pins on the IPFS node match the saved and important messages, see SyncPins
+func PinCommand(args []string) error {
+	f := newFlags("pin")
+	lead := f.Int("lead", -1, "also pin the messages with at least this lead from now on, 0 only pins saved messages, -1 keeps the current setting")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	store := SQLiteStore{db}
+	if *lead >= 0 {
+		if err := store.SetSetting(PinLeadSetting, fmt.Sprint(*lead)); err != nil {
+			return err
+		}
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	pinned, unpinned, err := SyncPins(Network, store)
+	fmt.Println("Pinned", pinned, "and unpinned", unpinned, "messages")
+	return err
+}
+
+// ExpireCommand removes the expired messages from the database, optionally changing how long messages are kept first
+func ExpireCommand(args []string) error {
+	f := newFlags("expire")
+	period := f.Duration("period", -1, "keep messages without proof of work this long from now on, 0 keeps all messages, -1 keeps the current setting")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	store := SQLiteStore{db}
+	r := LoadRetention(store)
+	if *period >= 0 {
+		r.Period = *period
+		if err := SaveRetention(store, r); err != nil {
+			return err
+		}
+	}
+	_, stored, err := ExpireMessages(store, &message.Messages{}, r, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Removed", stored, "expired messages")
+	return nil
+}
+
+// TrimCommand removes all but the most important messages from the database
+func TrimCommand(args []string) error {
+	f := newFlags("trim")
+	keep := f.Int("keep", 1000, "number of messages to keep, besides the saved ones")
+	unpin := f.Bool("unpin", false, "also unpin the removed messages on the IPFS node")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	removed, err := TrimDatabaseTo(db, *keep)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Removed", removed, "messages")
+	if !*unpin {
+		return nil
+	}
+	if err := f.connect(); err != nil {
+		return err
+	}
+	pinned, unpinned, err := SyncPins(Network, SQLiteStore{db})
+	fmt.Println("Pinned", pinned, "and unpinned", unpinned, "messages")
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// DaemonCommand runs Infodump as a long running service, see RunDaemon
+func DaemonCommand(args []string) error {
+	f := newFlags("daemon")
+	republish := f.Duration("republish", 10*time.Minute, "how often to publish the stored messages and pull the followed feeds, 0 never does")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := f.connect(); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	RunDaemon(ctx, Network, SQLiteStore{db}, *republish)
+	return nil
+}
+
+// RunDaemon listens on "OLN" and the followed tags until the context is done
+// Every valid message that comes in and isn't known yet is saved to the store right away,
+// and every republish interval the new messages are published to the network,
+// or the last batch is announced again if there are none, after which the feed of the node is published
+// and the followed feeds are pulled, and the pins are updated, see SyncPins
+// Every retention interval the expired messages are removed, see Retention, with the settings of when it started
+// The transport is used to talk to the network
+// When the context is done it waits for the listeners to stop before returning
+func RunDaemon(ctx context.Context, t transport.Transport, store Store, republish time.Duration) {
+	// Start with what is in the store, so known messages are not saved again
+	stored, err := store.Load()
+	if err != nil {
+		fmt.Println("Error reading the stored messages:", err)
+	} else {
+		LocalMessages.AddMany(stored)
+	}
+	fmt.Println("Daemon started with", len(LocalMessages.MessageList()), "messages")
+
+	// Messages that are expired already are not saved, so they don't come back after they are removed
+	retention := LoadRetention(store)
+	expire := time.NewTicker(retention.Interval)
+	defer expire.Stop()
+
+	// Pulling the feeds and expiring change the messages too, so they hold the same lock as saving what is received
+	var lock sync.Mutex
+	unexpired := func(topic string, msgs *message.Messages) *message.Messages {
+		return retention.Unexpired(msgs, time.Now())
+	}
+	listeners := ListenForMessages(ctx, t, store, &LocalMessages, saveBatches(&lock, store, &LocalMessages, unexpired, func(topic string, count int) {
+		fmt.Println("Saved", count, "new messages from", topic)
+	}))
+
+	var tick <-chan time.Time
+	if republish > 0 {
+		ticker := time.NewTicker(republish)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopping daemon...")
+			listeners.Wait()
+			fmt.Println("Daemon stopped")
+			return
+		case <-tick:
+			cid, err := PublishMessages(t, store, &LocalMessages)
+			if err != nil {
+				fmt.Println("Error republishing messages:", err)
+			} else if cid != "" {
+				if _, err := PublishFeed(t, store); err != nil {
+					fmt.Println("Error publishing feed:", err)
+				}
+			}
+			lock.Lock()
+			saved, err := SaveNewMessages(store, &LocalMessages, retention.Unexpired(PullFeeds(t, store, &LocalMessages), time.Now()), SourceFeeds)
+			lock.Unlock()
+			if err != nil {
+				fmt.Println("Error saving the messages of the followed feeds:", err)
+			} else if saved > 0 {
+				fmt.Println("Saved", saved, "new messages from the followed feeds")
+			}
+			if _, _, err := SyncPins(t, store); err != nil {
+				fmt.Println("Error updating the pins:", err)
+			}
+		case <-expire.C:
+			lock.Lock()
+			local, stored, err := ExpireMessages(store, &LocalMessages, retention, time.Now())
+			lock.Unlock()
+			if err != nil {
+				fmt.Println("Error removing expired messages:", err)
+			} else if stored > 0 {
+				fmt.Println("Removed", stored, "expired messages,", local, "of them from memory")
+			}
+		}
+	}
+}
+
+// SaveNewMessages saves the messages that are not in known yet to the store with the source, see Store.Save,
+// and adds them to known
+// It returns how many messages were new, if saving fails none of them are saved or added to known
+func SaveNewMessages(store Store, known *message.Messages, msgs *message.Messages, source string) (int, error) {
+	fresh := &message.Messages{}
+	msgs.Each(func(m *message.Message) {
+		if known.Get(m.Stamp()) == nil {
+			fresh.Add(m)
+		}
+	})
+	if fresh.Len() == 0 {
+		return 0, nil
+	}
+	report, err := store.Save(fresh, source)
+	if err != nil {
+		return 0, err
+	}
+	known.AddMany(fresh)
+	return report.New, nil
+}
@@ -1,70 +1,279 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	_ "modernc.org/sqlite"
 
-	shell "github.com/ipfs/go-ipfs-api"
-
 	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
 )
 
 var DatabasePath = "infodump.db"
 var DB *sql.DB
 
+// stopOLNListener stops the listener started by StartOLNListener, if any
+var stopOLNListener func()
+
 // StartOLNListener starts a PubSub listener that listens for messages from the network
-// and adds them to LocalMessages
+// and adds them to LocalMessages and the database
 // For this it uses the IPFS gateway and listens on the topic "OLN", as well as
 // the list of followed tags from the database
+// The new messages are saved right away, because the batches they came in are remembered as read
+// and are not fetched again after a restart
+// Starting it again restarts it, so it picks up changes to the followed tags
 func StartOLNListener() {
-	// Get the IPFS gateway
-	gateway := message.IPFSGateway
-	// Get the database
+	StopOLNListener()
 	db := GetDatabase()
-	// Get the list of followed tags
-	followedTags := GetFollowedTags(db)
-	// Create a new IPFS client
-	myIPFS := shell.NewShell(gateway)
-	var subs []*shell.PubSubSubscription
-	olnsub, err := myIPFS.PubSubSubscribe("OLN")
+	ctx, cancel := context.WithCancel(context.Background())
+	store := SQLiteStore{db}
+	listeners := ListenForMessages(ctx, Network, store, &LocalMessages, saveBatches(&sync.Mutex{}, store, &LocalMessages, nil, nil))
+	stopOLNListener = func() {
+		cancel()
+		listeners.Wait()
+	}
+}
+
+// StopOLNListener stops the listener started by StartOLNListener and waits until it is done
+func StopOLNListener() {
+	if stopOLNListener != nil {
+		stopOLNListener()
+		stopOLNListener = nil
+	}
+}
+
+// MaxListenBackoff is the longest time to wait before subscribing to a topic again after an error
+var MaxListenBackoff = 5 * time.Minute
+
+// MaxHistoryDepth is the number of batches a listener reads at most when it follows the chain of a topic back
+var MaxHistoryDepth = 10
+
+// MaxLoadedBatches is the number of received batches a listener loads from the store when it starts,
+// the last received ones, so starting doesn't take longer the longer the node runs
+// An older batch that is announced again is read again, but its messages are known already, so they are not fetched
+var MaxLoadedBatches = 10000
+
+// batchHistory remembers the batches a listener has read on each of its topics, with the number of messages in them,
+// so it only follows the chain of a topic back to the first batch it knows, and doesn't read a batch again
+// Batches with the same messages on different topics have the same CID, so it is kept per topic
+// known are the messages the listener has already, those are not fetched again, see message.BatchFromIPFS
+// If store is set, the announced batches are recorded there, and the history starts with what it recorded before
+type batchHistory struct {
+	known *message.Messages
+	store Store
+	lock  sync.Mutex
+	read  map[string]map[string]int
+}
+
+// load adds the last MaxLoadedBatches batches that were recorded in the store before
+func (h *batchHistory) load() {
+	if h.store == nil {
+		return
+	}
+	batches, err := h.store.ReceivedBatches(MaxLoadedBatches)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("Error reading the received batches:", err)
+	}
+	for _, b := range batches {
+		h.add(b.Topic, b.CID, b.Count)
+	}
+}
+
+// seen checks if the batch with the CID was read on the topic already, and returns how many messages it had
+func (h *batchHistory) seen(topic, cid string) (int, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	count, ok := h.read[topic][cid]
+	return count, ok
+}
+
+// add remembers that the batch with the CID was read on the topic
+func (h *batchHistory) add(topic, cid string, count int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.read == nil {
+		h.read = make(map[string]map[string]int)
+	}
+	if h.read[topic] == nil {
+		h.read[topic] = make(map[string]int)
+	}
+	h.read[topic][cid] = count
+}
+
+// record remembers in the store that the peer announced the batch on the topic, if there is a store
+func (h *batchHistory) record(topic, cid, peer string, count int) {
+	if h.store == nil {
 		return
 	}
-	subs = append(subs, olnsub)
-	for _, tag := range followedTags {
-		tagssub, err := myIPFS.PubSubSubscribe("oln-" + tag)
+	err := h.store.RecordBatch(ReceivedBatch{CID: cid, Topic: topic, Peer: peer, Count: count, ReceivedAt: time.Now()})
+	if err != nil {
+		fmt.Println("Error recording", cid, "from", peer+":", err)
+	}
+}
+
+// ListenForMessages subscribes to the topic "OLN" and the followed tags in the store
+// and calls handle with the valid messages of every CID that is published on them
+// When handle returns an error, the batch is not recorded, so it is read again when it is announced again
+// Every announced CID is recorded in the store, and a CID that was read on the topic before is not read again,
+// also not after a restart
+// The transport is used to subscribe and to get the messages from the network
+// The subscriptions are read in the background until the context is done,
+// the returned WaitGroup is done when all of them have stopped
+func ListenForMessages(ctx context.Context, t transport.Transport, store Store, known *message.Messages, handle func(topic string, msgs *message.Messages) error) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	history := &batchHistory{known: known, store: store}
+	history.load()
+	for _, topic := range FollowedTopics(store) {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			listenTopic(ctx, t, topic, history, handle)
+		}(topic)
+	}
+	return &wg
+}
+
+// FollowedTopics returns the PubSub topics to listen on: "OLN" and the topics of the followed tags in the store
+// If the followed tags can't be read, it only listens on "OLN"
+func FollowedTopics(store Store) []string {
+	topics := []string{"OLN"}
+	seen := map[string]bool{"OLN": true}
+	tags, err := store.FollowedTags()
+	if err != nil {
+		fmt.Println("Error reading the followed tags:", err)
+	}
+	for _, tag := range tags {
+		topic := "oln-" + tag
+		if t, ok := message.ParseTag(tag); ok {
+			topic = t.Topic()
+		}
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// saveBatches returns a handler for ListenForMessages that saves the new messages of every batch to the store
+// and adds them to known, see SaveNewMessages
+// If keep is not nil, only the messages it returns are saved, and saved, if not nil, is told how many of them were new
+// The subscriptions are read concurrently, so it saves one batch at a time while holding lock,
+// which others that change known and the store can hold too
+func saveBatches(lock *sync.Mutex, store Store, known *message.Messages, keep func(topic string, msgs *message.Messages) *message.Messages, saved func(topic string, count int)) func(topic string, msgs *message.Messages) error {
+	return func(topic string, msgs *message.Messages) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if keep != nil {
+			msgs = keep(topic, msgs)
+		}
+		count, err := SaveNewMessages(store, known, msgs, TopicSource(topic))
+		if saved != nil && count > 0 {
+			saved(topic, count)
+		}
+		return err
+	}
+}
+
+// listenTopic subscribes to a topic and reads it until the context is done
+// If the subscription fails, it subscribes again after a while, waiting twice as long every time up to MaxListenBackoff
+func listenTopic(ctx context.Context, t transport.Transport, topic string, history *batchHistory, handle func(topic string, msgs *message.Messages) error) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		sub, err := t.Subscribe(topic)
+		if err == nil {
+			backoff = time.Second
+			err = readSubscription(ctx, t, topic, sub, history, handle)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("Error reading from PubSub on", topic+":", err, "- trying again in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > MaxListenBackoff {
+			backoff = MaxListenBackoff
+		}
+	}
+}
+
+// readSubscription reads the CIDs from the subscription and hands the valid messages of the batches over, see readBatches
+// It returns the error of the subscription, or nil when the context is done
+func readSubscription(ctx context.Context, t transport.Transport, topic string, sub transport.Subscription, history *batchHistory, handle func(topic string, msgs *message.Messages) error) error {
+	// Cancelling the subscription makes Next return
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		sub.Cancel()
+	}()
+	for {
+		msg, err := sub.Next()
 		if err != nil {
-			fmt.Println(err)
-		} else {
-			subs = append(subs, tagssub)
-		}
-	}
-	// Start a goroutine for each of the subscriptions in subs,
-	// read the CID from the Next method, look up the CID on IPFS,
-	// read this in via message.MessagesFromIPFS and add the message to LocalMessages
-	for _, sub := range subs {
-		go func(sub *shell.PubSubSubscription) {
-			for {
-				msg, err := sub.Next()
-				if err != nil {
-					fmt.Println("Error reading from PubSub:", err)
-					return
-				}
-				msgs, err := message.MessagesFromIPFS(string(msg.Data))
-				if err != nil {
-					fmt.Println("Error reading from IPFS:", err)
-					return
-				}
-				LocalMessages.AddMany(msgs)
+			if ctx.Err() != nil {
+				return nil
 			}
-		}(sub)
+			return err
+		}
+		readBatches(t, topic, msg.From, string(msg.Data), history, handle)
 	}
 }
 
+// readBatches looks up the batch with the CID that the peer announced on IPFS, verifies the stamps and signatures
+// of its messages and hands the valid ones over, then does the same for the batch before it, until it reaches a batch
+// that was read on the topic already or MaxHistoryDepth batches are read
+// The announced batch is recorded, also when it was read already, see batchHistory
+// The batches before it are only remembered while listening, the peer didn't announce them so they are not credited to it
+// A CID that can't be read or handled doesn't break the subscription, it is tried again when it is announced again
+// It returns the CID of the first batch it did not get to, or "" when it reached a batch that was read already or the start of the chain
+func readBatches(t transport.Transport, topic, peer, cid string, history *batchHistory, handle func(topic string, msgs *message.Messages) error) string {
+	if count, ok := history.seen(topic, cid); ok {
+		history.record(topic, cid, peer, count)
+		return ""
+	}
+	for depth := 0; cid != "" && depth < MaxHistoryDepth; depth++ {
+		if _, ok := history.seen(topic, cid); ok {
+			return ""
+		}
+		batch, err := message.BatchFromIPFS(t, cid, history.known)
+		if err != nil {
+			fmt.Println("Error reading", cid, "from IPFS:", err)
+			return cid
+		}
+		// Only keep the messages that have a valid stamp
+		valid, report := message.VerifyAll(batch.Messages)
+		if len(report.Rejected) > 0 {
+			fmt.Println("Received", cid, "on", topic, "-", report)
+		}
+		// Only remembered once the messages are handled, so they are read again if that failed
+		if err := handle(topic, valid); err != nil {
+			fmt.Println("Error handling", cid, "from", topic+":", err)
+			return cid
+		}
+		history.add(topic, cid, batch.Messages.Len())
+		if depth == 0 {
+			history.record(topic, cid, peer, batch.Messages.Len())
+		}
+		cid = batch.Previous
+	}
+	if _, ok := history.seen(topic, cid); ok {
+		return ""
+	}
+	return cid
+}
+
 // GetDatabase checks if DB is already set and opened, if not it Sets the database first
 func GetDatabase() *sql.DB {
 	if DB == nil {
@@ -74,61 +283,241 @@ func GetDatabase() *sql.DB {
 	return DB
 }
 
-func GetMessagesFromDatabase(db *sql.DB) *message.Messages {
-	// Get all messages from the database
-	rows, err := db.Query("SELECT hash, message, nonce, timestamp FROM messages")
+// GetStore returns the Store of the database, see GetDatabase
+func GetStore() Store {
+	return SQLiteStore{GetDatabase()}
+}
+
+// messageColumns are the columns of the "messages" table that make up a message, in the order scanMessage reads them
+const messageColumns = "hash, version, message, nonce, timestamp, parent, public_key, signature"
+
+// scanMessage reads a message from a row with the messageColumns, followed by the extra columns if any
+func scanMessage(rows *sql.Rows, extra ...interface{}) (string, *message.Message, error) {
+	var hash string
+	var m message.Message
+	var parent sql.NullString
+	dest := []interface{}{&hash, &m.Version, &m.Message, &m.Nonce, &m.Timestamp, &parent, &m.PublicKey, &m.Signature}
+	err := rows.Scan(append(dest, extra...)...)
+	m.Parent = parent.String
+	return hash, &m, err
+}
+
+// Importance is what is stored in the "importance" column of a message: the time, in Unix seconds, until which
+// the message is more important than new messages without proof of work according to message.DefaultRanker
+// It is Message.SortNum, so messages from the future are trimmed first, like in memory, until their time has come
+// and updateImportance gives them their real importance
+// Messages that stay important longer have a higher importance, and a message has expired once its importance
+// plus the retention period has passed, see Retention
+func Importance(m *message.Message) int64 {
+	return m.SortNum()
+}
+
+// SourceLocal is the source of the messages that were written on this node or saved from LocalMessages
+// The messages from the network are stored with the topic or CID they came from, see TopicSource and CIDSource
+const SourceLocal = "local"
+
+// SourceFeeds is the source of the messages that were pulled from the followed feeds
+const SourceFeeds = "feeds"
+
+// TopicSource is the source of the messages that were received on a PubSub topic
+func TopicSource(topic string) string {
+	return "pubsub:" + topic
+}
+
+// CIDSource is the source of the messages that were pulled by their CID
+func CIDSource(cid string) string {
+	return "cid:" + cid
+}
+
+// StoreReport tells how many of the stored messages were new, and how many were in the database already
+type StoreReport struct {
+	New   int
+	Known int
+}
+
+// String method for StoreReport: "*new* new messages, *known* already known"
+func (r StoreReport) String() string {
+	return fmt.Sprintf("%d new messages, %d already known", r.New, r.Known)
+}
+
+// StoreMessages stores the messages in the database in one transaction, so either all of them are stored or none
+// Messages that are in the database already are left as they are, so they keep when and where they were first seen
+func StoreMessages(db *sql.DB, msgs *message.Messages, source string) (StoreReport, error) {
+	var report StoreReport
+	seen := time.Now().Unix()
+	err := withTx(db, func(tx *sql.Tx) error {
+		var err error
+		msgs.Each(func(m *message.Message) {
+			if err != nil {
+				return
+			}
+			var added bool
+			added, err = upsertMessage(tx, m, source, seen)
+			if added {
+				report.New++
+			} else if err == nil {
+				report.Known++
+			}
+		})
+		return err
+	})
 	if err != nil {
-		fmt.Println(err)
+		return StoreReport{}, err
 	}
-	defer rows.Close()
-	// Create a new Messages object
+	return report, nil
+}
+
+// InsertMessage stores a single message in the "messages" table as a message of this node
+// Nothing happens if the message is in the database already
+func InsertMessage(db *sql.DB, m *message.Message) error {
+	_, err := upsertMessage(db, m, SourceLocal, time.Now().Unix())
+	return err
+}
+
+// upsertMessage stores the message with its tags, unless it is in the database already, and tells if it was new
+func upsertMessage(db execer, m *message.Message, source string, seen int64) (bool, error) {
+	var parent sql.NullString
+	if m.Parent != "" {
+		parent = sql.NullString{String: m.Parent, Valid: true}
+	}
+	result, err := db.Exec("INSERT INTO messages("+messageColumns+", importance, first_seen, source) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(hash) DO NOTHING",
+		m.Stamp(), m.Version, m.Message, m.Nonce, m.Timestamp, parent, m.PublicKey, m.Signature, Importance(m), seen, source)
+	if err != nil {
+		return false, err
+	}
+	if added, err := result.RowsAffected(); err != nil || added == 0 {
+		return false, err
+	}
+	return true, insertTags(db, m.Stamp(), m.Tags())
+}
+
+// GetMessageOrigin returns when the message was first seen and where it came from
+// Messages that were stored before this was kept have no source and a zero time
+func GetMessageOrigin(db *sql.DB, stamp string) (time.Time, string, error) {
+	var seen sql.NullInt64
+	var source sql.NullString
+	err := db.QueryRow("SELECT first_seen, source FROM messages WHERE hash = ?", stamp).Scan(&seen, &source)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if !seen.Valid {
+		return time.Time{}, source.String, nil
+	}
+	return time.Unix(seen.Int64, 0), source.String, nil
+}
+
+// queryMessages runs a query that selects the messageColumns and returns the resulting messages
+// Errors are shown on stderr, so they don't mix with the output of the commands, and the messages that could be read are returned
+func queryMessages(db *sql.DB, query string, args ...interface{}) *message.Messages {
+	msgs, err := selectMessages(db, query, args...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return msgs
+}
+
+// selectMessages runs a query that selects the messageColumns and returns the resulting messages,
+// it stops at the first error
+func selectMessages(db *sql.DB, query string, args ...interface{}) (*message.Messages, error) {
 	msgs := message.Messages{}
-	// Loop through all messages
-	fmt.Println("Getting messages from database...")
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return &msgs, err
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var hash, msg string
-		var nonce int
-		var timestamp int64
-		// Get the values from the database
-		err := rows.Scan(&hash, &msg, &nonce, &timestamp)
+		_, m, err := scanMessage(rows)
 		if err != nil {
-			fmt.Println(err)
+			return &msgs, err
 		}
-		fmt.Println("Got message from database:", hash)
+		msgs.Add(m)
+	}
+	return &msgs, rows.Err()
+}
 
-		// Create a new message object
-		m := message.Message{
-			Message:   msg,
-			Nonce:     nonce,
-			Timestamp: timestamp,
-		}
-		// Add the message to the Messages object
-		fmt.Println("Adding message to Messages object...")
-		msgs.Add(&m)
+// withTx runs change in a transaction and commits it if change succeeds, so either all of it is done or nothing
+func withTx(db *sql.DB, change func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback does nothing once the transaction is committed
+	defer tx.Rollback()
+	if err := change(tx); err != nil {
+		return err
 	}
-	return &msgs
+	return tx.Commit()
 }
 
-func InitDatabase(db *sql.DB) {
-	var err error
-	// Create the table "messages"
-	_, err = db.Exec("CREATE TABLE messages(hash TEXT PRIMARY KEY, message TEXT, nonce INTEGER, timestamp INTEGER)")
+// queryColumn runs a query that selects a single text column and returns the values
+func queryColumn(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return values, err
+		}
+		values = append(values, value)
 	}
-	// Create the table "followed_tags"
-	_, err = db.Exec("CREATE TABLE followed_tags(tag TEXT)")
+	return values, rows.Err()
+}
+
+func GetMessagesFromDatabase(db *sql.DB) *message.Messages {
+	// Get all messages from the database
+	return queryMessages(db, "SELECT "+messageColumns+" FROM messages")
+}
+
+// FindMessagesInDatabase returns the messages in the database of which the stamp starts with the given prefix
+func FindMessagesInDatabase(db *sql.DB, prefix string) *message.Messages {
+	return queryMessages(db, "SELECT "+messageColumns+" FROM messages WHERE substr(hash, 1, ?) = ?", len(prefix), prefix)
+}
+
+// GetAncestorsFromDatabase gets the message with the given stamp and the message it replies to,
+// and the one that replies to, up to the start of the conversation, from the database
+func GetAncestorsFromDatabase(db *sql.DB, stamp string) *message.Messages {
+	return queryMessages(db, `WITH RECURSIVE ancestors(hash) AS (
+		SELECT ? UNION SELECT messages.parent FROM messages JOIN ancestors ON messages.hash = ancestors.hash WHERE messages.parent IS NOT NULL
+	) SELECT `+messageColumns+` FROM messages WHERE hash IN ancestors`, stamp)
+}
+
+// GetThreadFromDatabase gets the message with the given stamp and all replies to it, and the replies to those, from the database
+func GetThreadFromDatabase(db *sql.DB, stamp string) *message.Messages {
+	return queryMessages(db, `WITH RECURSIVE thread(hash) AS (
+		SELECT ? UNION SELECT messages.hash FROM messages JOIN thread ON messages.parent = thread.hash
+	) SELECT `+messageColumns+` FROM messages WHERE hash IN thread`, stamp)
+}
+
+// GetReplyCountsFromDatabase maps the stamp of every message that has replies in the database to the number of direct replies
+func GetReplyCountsFromDatabase(db *sql.DB) map[string]int {
+	counts := make(map[string]int)
+	rows, err := db.Query("SELECT parent, COUNT(*) FROM messages WHERE parent IS NOT NULL GROUP BY parent")
 	if err != nil {
 		fmt.Println(err)
+		return counts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var parent string
+		var count int
+		if err := rows.Scan(&parent, &count); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		counts[parent] = count
 	}
+	return counts
 }
 
 // SetDatabase configures DB to be the database to use
 // The name used is DatabasePath, but the user will be asked if this correct or if they want to change it
 // If the database is already set, it will ask the user if they want to overwrite it
 // If the database is not set, it will ask the user if they want to create it
-// If the database is set but it doesn't contain the tables "messages" and "followed_tags",
-// it will create them
+// The database is upgraded to the latest schema before it is used, see Migrate
 func SetDatabase() {
 	// First check if the user is okay with the database path
 	fmt.Println("Database path: ", DatabasePath)
@@ -139,7 +528,7 @@ func SetDatabase() {
 		DatabasePath = Readline()
 	}
 	// Open the database
-	db, err := sql.Open("sqlite", DatabasePath)
+	db, err := sql.Open("sqlite", databaseSource(DatabasePath))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -160,11 +549,17 @@ func SetDatabase() {
 			return
 		}
 	}
+	// Create the tables or upgrade them to the latest schema
+	err = Migrate(db)
+	if err != nil {
+		fmt.Println(err)
+		db.Close()
+		return
+	}
 	// Set the database
 	DB = db
-	// Check if the database contains the tables "messages" and "followed_tags"
-	// If not, create them
-	InitDatabase(DB)
+	// Use the identity that is stored next to the database, if there is one
+	LoadLocalIdentity()
 }
 
 func TrimDatabase() {
@@ -174,20 +569,37 @@ func TrimDatabase() {
 	fmt.Scan(&num)
 	// Get the database
 	db := GetDatabase()
-	// Get the list of messages
-	msgs := GetMessagesFromDatabase(db)
-	// Trim the list of messages
-	msgs.Trim(num)
-	// Delete all messages from the database
-	_, err := db.Exec("DELETE FROM messages")
+	removed, err := TrimDatabaseTo(db, num)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	// Add the trimmed list of messages to the database
-	msgs.Each(func(m *message.Message) {
-		_, err := db.Exec("INSERT INTO messages(hash, message, nonce, timestamp) VALUES(?, ?, ?, ?)", m.Stamp(), m.Message, m.Nonce, m.Timestamp)
+	fmt.Println("Removed", removed, "messages from the database")
+	// Unpin what was trimmed
+	UpdatePins(SQLiteStore{db})
+}
+
+// TrimDatabaseTo removes all but the num most important messages from the database and returns how many it removed
+// Saved messages are always kept, on top of the num most important other messages
+// Only the messages below the cutoff are deleted, in one transaction, so the database is never left half trimmed
+// The pins of the removed messages stay until SyncPins removes them
+func TrimDatabaseTo(db *sql.DB, num int) (int64, error) {
+	var removed int64
+	err := withTx(db, func(tx *sql.Tx) error {
+		if err := updateImportance(tx, time.Now()); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`DELETE FROM messages WHERE saved = 0 AND hash NOT IN (
+			SELECT hash FROM messages WHERE saved = 0 ORDER BY importance DESC, hash LIMIT ?
+		)`, num)
 		if err != nil {
-			fmt.Println(err)
+			return err
 		}
+		removed, err = result.RowsAffected()
+		return err
 	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
 }
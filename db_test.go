@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// newTestDB opens a new database in a temporary directory, which is closed when the test is done
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "infodump.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Test that storing messages again only adds the new ones and keeps where the others were first seen
+func TestStoreMessages(t *testing.T) {
+	db := newTestDB(t)
+	first, _ := message.New("first news about #go", 0, time.Now().Unix(), time.Minute)
+	second, _ := message.New("second news about #go", 0, time.Now().Unix(), time.Minute)
+
+	report, err := StoreMessages(db, messagesOf(first), TopicSource("#go"))
+	if err != nil || report.New != 1 || report.Known != 0 {
+		t.Fatalf("expected 1 new message, got %v %v", report, err)
+	}
+	report, err = StoreMessages(db, messagesOf(first, second), CIDSource("bafy"))
+	if err != nil || report.New != 1 || report.Known != 1 {
+		t.Fatalf("expected 1 new and 1 known message, got %v %v", report, err)
+	}
+	if err := InsertMessage(db, first); err != nil {
+		t.Errorf("expected inserting a known message to do nothing, got %v", err)
+	}
+
+	seen, source, err := GetMessageOrigin(db, first.Stamp())
+	if err != nil || source != "pubsub:#go" || seen.IsZero() {
+		t.Errorf("expected the first message to be from pubsub:#go, got %v %q %v", seen, source, err)
+	}
+	if _, source, _ := GetMessageOrigin(db, second.Stamp()); source != "cid:bafy" {
+		t.Errorf("expected the second message to be from cid:bafy, got %q", source)
+	}
+	if got := stamps(GetMessagesWithTag(db, "#go")); len(got) != 2 {
+		t.Errorf("expected the tags to be stored once for both messages, got %v", got)
+	}
+	var tags int
+	db.QueryRow("SELECT COUNT(*) FROM message_tags").Scan(&tags)
+	if tags != 2 {
+		t.Errorf("expected 2 tags, got %d", tags)
+	}
+}
+
+// Test that a conversation that is only in the database is found from any of its messages
+func TestConversationFromDatabase(t *testing.T) {
+	useTestDatabase(t)
+	now := time.Now().Unix()
+	root := &message.Message{Version: message.CurrentVersion, Message: "root", Timestamp: now}
+	reply := &message.Message{Version: message.CurrentVersion, Message: "reply", Timestamp: now, Parent: root.Stamp()}
+	answer := &message.Message{Version: message.CurrentVersion, Message: "answer", Timestamp: now, Parent: reply.Stamp()}
+	SaveMessages(SQLiteStore{DB}, messagesOf(root, reply, answer), SourceLocal)
+
+	if m := FindMessage(answer.Stamp()[:12]); m == nil || m.Stamp() != answer.Stamp() {
+		t.Fatalf("expected to find the answer in the database, got %v", m)
+	}
+	ancestors := GetAncestorsFromDatabase(DB, answer.Stamp())
+	if got, want := stamps(ancestors), stamps(messagesOf(root, reply, answer)); !equalStrings(got, want) {
+		t.Errorf("expected the answer and the messages before it, got %v", got)
+	}
+	if got := ancestors.Root(answer.Stamp()); got != root.Stamp() {
+		t.Errorf("expected %s to be the start of the conversation, got %s", root.Stamp(), got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// Every node can publish the last batch it published on "OLN" under its IPNS name, that is its feed
+// Since the batches link to the ones before them, a node that follows the feed can catch up on
+// everything it missed while it was offline, without having to be there when a CID is announced on PubSub
+
+// ConfigureFollowedFeeds shows the followed feeds and asks for feeds to follow and to stop following
+func ConfigureFollowedFeeds() {
+	store := GetStore()
+	fmt.Println("At the moment you follow the following feeds:")
+	for _, name := range GetFollowedFeeds(store) {
+		fmt.Println(name)
+	}
+	fmt.Println("Enter the IPNS names of the feeds you want to follow, separated by spaces\nTo remove feeds, prefix them with a minus sign: ")
+	for _, name := range strings.Fields(Readline()) {
+		var err error
+		if !strings.HasPrefix(name, "-") {
+			err = store.FollowFeed(name)
+		} else {
+			err = store.UnfollowFeed(name[1:])
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// PublishOwnFeed publishes the feed of this node, so others can follow it
+func PublishOwnFeed() {
+	name, err := PublishFeed(Network, GetStore())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Others can follow your feed as", name)
+}
+
+// PullFollowedFeeds gets the new messages of the followed feeds and adds them to LocalMessages
+func PullFollowedFeeds() {
+	msgs := PullFeeds(Network, GetStore(), &LocalMessages)
+	fmt.Println("Got", msgs.Len(), "messages from the followed feeds")
+	LocalMessages.AddMany(msgs)
+}
+
+// feedName takes the name of a feed as a user would give it, with or without /ipns/ in front
+func feedName(name string) string {
+	return strings.TrimPrefix(strings.TrimSpace(name), "/ipns/")
+}
+
+// GetFollowedFeeds returns the IPNS names of the followed feeds in the store
+func GetFollowedFeeds(store Store) []string {
+	names, err := store.FollowedFeeds()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return names
+}
+
+// FeedState is how far a followed feed was pulled
+type FeedState struct {
+	// Last is the head of the feed at the last pull that read everything since the one before
+	Last string
+	// Resume is the first batch a pull did not get to, and ResumeHead the head of the feed at that pull,
+	// both are empty when the last pull read everything
+	Resume     string
+	ResumeHead string
+}
+
+// PublishFeed points the IPNS name of the node to the last batch it published on "OLN", as the store remembers it,
+// and returns the name
+func PublishFeed(t transport.Transport, store Store) (string, error) {
+	head, err := store.LastPublishedBatch("OLN")
+	if err != nil {
+		return "", err
+	}
+	if head == "" {
+		return "", fmt.Errorf("nothing is published yet, write messages to the network first")
+	}
+	name, err := t.NamePublish(head)
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Published feed /ipns/"+name, "at", head)
+	return name, nil
+}
+
+// PullFeeds gets the new messages of all followed feeds, see PullFeed
+// A feed that can't be pulled is skipped, so the others still are
+func PullFeeds(t transport.Transport, store Store, known *message.Messages) *message.Messages {
+	msgs := &message.Messages{}
+	for _, name := range GetFollowedFeeds(store) {
+		pulled, err := PullFeed(t, store, name, known)
+		if err != nil {
+			fmt.Println("Error pulling feed", name+":", err)
+			continue
+		}
+		msgs.AddMany(pulled)
+	}
+	return msgs
+}
+
+// PullFeed resolves the IPNS name of a followed feed and returns the valid messages of the batches
+// that were published since the last pull, following the chain back at most MaxHistoryDepth batches
+// When there are more, the next pull continues where this one stopped, before it looks at the new batches of the feed
+// Messages that are in known are not fetched again, see message.BatchFromIPFS
+func PullFeed(t transport.Transport, store Store, name string, known *message.Messages) (*message.Messages, error) {
+	name = feedName(name)
+	state, err := store.Feed(name)
+	if err != nil {
+		return nil, err
+	}
+	// head is the batch that becomes the last pulled one once everything before it is read
+	start, head := state.Resume, state.ResumeHead
+	if start == "" {
+		head, err = t.NameResolve(name)
+		if err != nil {
+			return nil, err
+		}
+		start = head
+	}
+	msgs := &message.Messages{}
+	// The feed is read like a topic, which stops at the batch that was pulled last time
+	topic := "/ipns/" + name
+	history := &batchHistory{known: known}
+	if state.Last != "" {
+		history.add(topic, state.Last, 0)
+	}
+	next := readBatches(t, topic, name, start, history, func(topic string, valid *message.Messages) error {
+		msgs.AddMany(valid)
+		return nil
+	})
+	if next == start {
+		return nil, fmt.Errorf("could not read %s", start)
+	}
+	if next != "" {
+		return msgs, store.SetFeed(name, FeedState{Last: state.Last, Resume: next, ResumeHead: head})
+	}
+	return msgs, store.SetFeed(name, FeedState{Last: head})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// LocalIdentity is the identity used to sign messages, nil if messages are sent anonymously
+var LocalIdentity *message.Identity
+
+// IdentityPath returns the path of the key file, which is stored alongside the database
+// For the default database infodump.db this is infodump.key
+func IdentityPath() string {
+	return strings.TrimSuffix(DatabasePath, filepath.Ext(DatabasePath)) + ".key"
+}
+
+// LoadLocalIdentity sets LocalIdentity to the identity stored alongside the database, if there is one
+func LoadLocalIdentity() {
+	id, err := message.LoadIdentity(IdentityPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		LocalIdentity = nil
+		return
+	}
+	LocalIdentity = id
+	fmt.Println("Using identity", id.Fingerprint())
+}
+
+// ConfigureIdentity shows the current identity and lets the user create a new one
+func ConfigureIdentity() {
+	if LocalIdentity != nil {
+		fmt.Println("Your identity is", LocalIdentity.Fingerprint())
+		fmt.Println("Do you want to replace it with a new identity? People will not recognize you anymore (y/n)")
+	} else {
+		fmt.Println("You don't have an identity yet, your messages are sent anonymously")
+		fmt.Println("Do you want to create an identity so people can recognize your messages? (y/n)")
+	}
+	answer := Readline()
+	if answer != "y" {
+		return
+	}
+	id, err := message.NewIdentity()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = id.Save(IdentityPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	LocalIdentity = id
+	fmt.Println("Created identity", id.Fingerprint(), "in", IdentityPath())
+}
@@ -3,15 +3,30 @@ package main
 import (
 	"fmt"
 
-	"git.kiefte.eu/lapingvino/infodump/message"
-	shell "github.com/ipfs/go-ipfs-api"
+	"git.kiefte.eu/lapingvino/infodump/transport"
 )
 
+// IPFSGateway is the address of the API of the IPFS daemon Infodump talks to
+var IPFSGateway = "http://localhost:5001"
+
+// Network is the transport the menu and the commands use to talk to the network, see UseIPFSGateway
+var Network transport.Transport = transport.NewIPFS(IPFSGateway)
+
+// UseIPFSGateway makes the IPFS daemon with the given API address the one to talk to
+func UseIPFSGateway(gateway string) {
+	IPFSGateway = gateway
+	Network = transport.NewIPFS(gateway)
+}
+
 func TestIPFSGateway(gateway string) error {
 	// Test the IPFS gateway
 	fmt.Println("Testing IPFS gateway...")
-	ipfs := shell.NewShell(gateway)
-	_, err := ipfs.ID()
+	return TestTransport(transport.NewIPFS(gateway))
+}
+
+// TestTransport checks if the network can be reached through the transport
+func TestTransport(t transport.Transport) error {
+	_, err := t.ID()
 	return err
 }
 
@@ -27,6 +42,6 @@ func SetIPFSGateway() {
 		return
 	} else {
 		fmt.Println("IPFS gateway set to: ", gateway)
-		message.IPFSGateway = gateway
+		UseIPFSGateway(gateway)
 	}
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport/ipfstest"
+)
+
+// useFakeIPFS starts a fake IPFS daemon and makes it the one to use until the test is done
+func useFakeIPFS(t *testing.T) *ipfstest.Server {
+	server := ipfstest.NewServer()
+	gateway := IPFSGateway
+	UseIPFSGateway(server.URL)
+	t.Cleanup(func() {
+		StopOLNListener()
+		server.Close()
+		UseIPFSGateway(gateway)
+	})
+	return server
+}
+
+// useTestDatabase makes a new database and empty LocalMessages the ones to use until the test is done
+func useTestDatabase(t *testing.T) {
+	path, db := DatabasePath, DB
+	DatabasePath = filepath.Join(t.TempDir(), "infodump.db")
+	var err error
+	DB, err = OpenDatabase(DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LocalMessages = message.Messages{}
+	t.Cleanup(func() {
+		DB.Close()
+		DatabasePath, DB = path, db
+		LocalMessages = message.Messages{}
+	})
+}
+
+func TestIPFSGatewayCheck(t *testing.T) {
+	server := useFakeIPFS(t)
+	if err := TestIPFSGateway(server.URL); err != nil {
+		t.Errorf("expected the fake IPFS daemon to work, got %v", err)
+	}
+	if server.Calls("id") != 1 {
+		t.Errorf("expected the gateway to be checked with id, got %d calls", server.Calls("id"))
+	}
+	server.Close()
+	if err := TestIPFSGateway(server.URL); err == nil {
+		t.Error("expected an error for a gateway that is gone")
+	}
+}
+
+// Test that the listener picks up valid messages on "OLN" and the followed tags, and drops forged ones
+func TestStartOLNListener(t *testing.T) {
+	server := useFakeIPFS(t)
+	useTestDatabase(t)
+	if err := FollowTag(DB, "#golang"); err != nil {
+		t.Fatal(err)
+	}
+	StartOLNListener()
+	defer StopOLNListener()
+	for _, topic := range []string{"OLN", "oln-#golang"} {
+		if !eventually(time.Second, func() bool { return server.Subscribers(topic) == 1 }) {
+			t.Fatalf("expected the listener to subscribe to %s", topic)
+		}
+	}
+
+	general, _ := message.New("hello network", 8, time.Now().Unix(), time.Minute)
+	tagged, _ := message.New("hello #golang", 8, time.Now().Unix(), time.Minute)
+	forged, _ := json.Marshal(map[string]*message.Message{
+		"00ff": {Version: message.CurrentVersion, Message: "forged", Timestamp: time.Now().Unix()},
+	})
+	server.Publish("OLN", []byte(server.Put(mustJSON(t, general))))
+	server.Publish("oln-#golang", []byte(server.Put(mustJSON(t, tagged))))
+	server.Publish("OLN", []byte(server.Put(forged)))
+	server.Publish("OLN", []byte("QmNotThere"))
+
+	received := eventually(5*time.Second, func() bool {
+		return LocalMessages.Get(general.Stamp()) != nil && LocalMessages.Get(tagged.Stamp()) != nil
+	})
+	if !received {
+		t.Fatalf("expected both messages to be received, got %v", LocalMessages.MessageList())
+	}
+	if n := len(LocalMessages.MessageList()); n != 2 {
+		t.Errorf("expected only the 2 valid messages, got %d", n)
+	}
+}
+
+// Test that writing to the network adds the messages and announces them on "OLN" and their tags
+func TestWriteMessagesToNetwork(t *testing.T) {
+	server := useFakeIPFS(t)
+	useTestDatabase(t)
+	m, _ := message.New("publishing #golang", 8, time.Now().Unix(), time.Minute)
+	LocalMessages.Add(m)
+
+	sub, err := Network.Subscribe("oln-#golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+	if !eventually(time.Second, func() bool { return server.Subscribers("oln-#golang") > 0 }) {
+		t.Fatal("expected the subscription to oln-#golang to reach the IPFS daemon")
+	}
+	WriteMessagesToNetwork()
+	if server.Calls("pubsub/pub") != 2 {
+		t.Errorf("expected a publish on OLN and on the tag, got %d", server.Calls("pubsub/pub"))
+	}
+
+	announced, err := sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, report, err := PullMessages(Network, string(announced.Data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rejected) != 0 || msgs.Get(m.Stamp()) == nil {
+		t.Errorf("expected the message under the tag, got %v %v", msgs.MessageList(), report)
+	}
+}
+
+// mustJSON returns the JSON of a Messages map with the given messages
+func mustJSON(t *testing.T, msgs ...*message.Message) []byte {
+	b, err := messagesOf(msgs...).JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"git.kiefte.eu/lapingvino/infodump/message"
@@ -14,13 +16,41 @@ var MessageCache string
 func ReadMessages() {
 	// Use LocalMessages to get the messages and get the sorted list of messages
 	// through the MessageList method
-	msgs := LocalMessages.MessageList()
+	ShowMessages(LocalMessages.MessageList())
+}
+
+// ReadMessagesNearby shows the messages in LocalMessages that are tagged with a place close to the one the user enters
+func ReadMessagesNearby() {
+	fmt.Println("Enter your location, as a geohash like u173z or as latitude,longitude like 52.37,4.89: ")
+	place := Readline()
+	p, ok := message.ParsePoint(place)
+	if !ok {
+		fmt.Println(place, "is not a geohash or a latitude,longitude")
+		return
+	}
+	fmt.Println("Show messages within how many km?")
+	var km float64
+	fmt.Scanln(&km)
+	ShowMessages(LocalMessages.Near(p, km).MessageList())
+}
+
+// ShowMessages shows the messages 10 at a time, with the number of replies they have
+func ShowMessages(msgs []*message.Message) {
+	// Count the replies per message, both the ones in memory and the ones in the database
+	replies := ReplyCounts()
 	// Loop through the messages and print them
 	for i, m := range msgs {
 		fmt.Println(m)
-		if i%10 == 9 {
-			fmt.Println("Press enter to continue... Type anything to stop")
+		if n := replies[m.Stamp()]; n > 0 {
+			fmt.Println("(", n, "replies )")
+		}
+		if i%10 == 9 || i == len(msgs)-1 {
+			fmt.Println("Press enter to continue... Type 'open' and the start of a message hash to open the conversation, anything else to stop")
 			contp := Readline()
+			if strings.HasPrefix(contp, "open ") {
+				OpenConversation(strings.TrimSpace(strings.TrimPrefix(contp, "open ")))
+				return
+			}
 			if contp != "" {
 				return
 			}
@@ -28,7 +58,13 @@ func ReadMessages() {
 	}
 }
 
+// WriteMessage lets the user write a new message that starts a conversation
 func WriteMessage() {
+	ComposeMessage("")
+}
+
+// ComposeMessage lets the user write a message, parent is the stamp of the message it replies to or empty
+func ComposeMessage(parent string) {
 	// Get a message and an urgency from the user.
 	// The urgency is used to set the strength of the Proof of Work
 	// If there is a message in the MessageCache, ask the user if they want to use it
@@ -50,24 +86,33 @@ func WriteMessage() {
 		fmt.Println("Write a message:")
 		m = Readline()
 	}
-	fmt.Println("Enter an urgency (higher is stronger but takes longer to produce): ")
-	var urgency int
-	fmt.Scanln(&urgency)
-	fmt.Println("How many seconds should we wait for the POW to be done? (default is 5): ")
-	var powtime int
-	fmt.Scanln(&powtime)
-	if powtime == 0 {
-		powtime = 5
+	// Create a new message object and sign it if the user wants to
+	msg := &message.Message{Version: message.CurrentVersion, Message: m, Timestamp: time.Now().Unix(), Parent: parent}
+	if LocalIdentity != nil {
+		fmt.Println("Sign this message as", LocalIdentity.Fingerprint()+"? (y/n)")
+		if Readline() != "n" {
+			LocalIdentity.Sign(msg)
+		}
+	}
+	// Let the user choose between a fixed urgency and a time budget for the proof of work
+	fmt.Println("1 Choose an urgency")
+	fmt.Println("2 Spend a number of seconds and get the best importance possible")
+	fmt.Println("Enter your choice (default is 1): ")
+	var mode int
+	fmt.Scanln(&mode)
+	var err error
+	if mode == 2 {
+		err = StampWithBudget(msg)
+	} else {
+		err = StampWithUrgency(msg)
 	}
-	// Create a new message object
-	msg, err := message.New(m, urgency, time.Now().Unix(), time.Duration(powtime)*time.Second)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("Want to try again with another urgency or timeout? (y/n)")
 		contp := Readline()
 		if contp == "y" {
 			MessageCache = m
-			WriteMessage()
+			ComposeMessage(parent)
 		}
 		return
 	}
@@ -90,6 +135,87 @@ func WriteMessage() {
 	}
 }
 
+// StampWithUrgency asks the user for an urgency, shows how long it is expected to take and creates the proof of work
+func StampWithUrgency(msg *message.Message) error {
+	fmt.Println("Enter an urgency (higher is stronger but takes longer to produce): ")
+	var urgency int
+	fmt.Scanln(&urgency)
+	if urgency < message.DefaultPolicy.MinLead {
+		fmt.Println("Warning: other peers drop messages with an urgency below", message.DefaultPolicy.MinLead)
+	}
+	// Measure how fast this machine is to suggest a timeout
+	expected := message.DefaultSolver.Estimate(urgency)
+	fmt.Println("On this machine an urgency of", urgency, "takes about", expected.Round(time.Millisecond))
+	defaultTime := 5
+	if suggested := int(2*expected.Seconds()) + 1; suggested > defaultTime {
+		defaultTime = suggested
+	}
+	fmt.Printf("How many seconds should we wait for the POW to be done? (default is %d): \n", defaultTime)
+	var powtime int
+	fmt.Scanln(&powtime)
+	if powtime == 0 {
+		powtime = defaultTime
+	}
+	// Search for the proof of work on all CPUs and show how it is going
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(powtime)*time.Second)
+	defer cancel()
+	solver := message.Solver{Progress: func(p message.Progress) { fmt.Println(p) }}
+	return solver.Solve(ctx, msg, urgency)
+}
+
+// StampWithBudget asks the user how many seconds to spend and creates the strongest proof of work possible in that time
+func StampWithBudget(msg *message.Message) error {
+	fmt.Println("How many seconds do you want to spend? (default is 5): ")
+	var budget int
+	fmt.Scanln(&budget)
+	if budget <= 0 {
+		budget = 5
+	}
+	solver := message.Solver{Progress: func(p message.Progress) { fmt.Println(p) }}
+	lead, err := solver.BestWithin(msg, time.Duration(budget)*time.Second)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Reached an importance of", lead, "leading zeroes")
+	if lead < message.DefaultPolicy.MinLead {
+		fmt.Println("Warning: other peers drop messages with an importance below", message.DefaultPolicy.MinLead)
+	}
+	return nil
+}
+
+// PostOptions are the settings for PostMessage
+// Parent is the stamp of the message to reply to, if any
+// Sign signs the message with LocalIdentity, if there is one
+// With a Budget, the strongest stamp found within it is used, otherwise Difficulty has to be reached within Timeout
+type PostOptions struct {
+	Parent     string
+	Sign       bool
+	Difficulty int
+	Timeout    time.Duration
+	Budget     time.Duration
+}
+
+// PostMessage creates a message with a proof of work without asking the user anything and adds it to LocalMessages
+func PostMessage(text string, opts PostOptions) (*message.Message, error) {
+	msg := &message.Message{Version: message.CurrentVersion, Message: text, Timestamp: time.Now().Unix(), Parent: opts.Parent}
+	if opts.Sign && LocalIdentity != nil {
+		LocalIdentity.Sign(msg)
+	}
+	if opts.Budget > 0 {
+		_, err := message.DefaultSolver.BestWithin(msg, opts.Budget)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := msg.ProofOfWork(opts.Difficulty, opts.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	LocalMessages.Add(msg)
+	return msg, nil
+}
+
 func TrimMessages() {
 	// Get the number of messages to keep from the user
 	fmt.Println("How many messages do you want to keep?")
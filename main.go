@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 
-	"git.kiefte.eu/lapingvino/infodump/message"
 	_ "modernc.org/sqlite"
 )
 
@@ -41,34 +41,54 @@ func Menu(menu []MenuElements) {
 }
 
 func main() {
-	fmt.Println("Welcome to Infodump")
-
-	// Set message IPFS client to use the local IPFS node
-	message.IPFSGateway = "http://localhost:5001"
-
-	// If the first argument to the command is a valid link, use that for the IPFSGateway instead
-	if len(os.Args) > 1 {
-		u, err := url.Parse(os.Args[1])
-		if err == nil {
-			message.IPFSGateway = u.String()
+	args := os.Args[1:]
+	// Without a command, or with only the address of the IPFS gateway like before there were commands,
+	// start the interactive menu
+	if len(args) == 0 || strings.Contains(args[0], "://") {
+		gateway := "http://localhost:5001"
+		if len(args) > 0 {
+			gateway = args[0]
 		}
+		Interactive(gateway)
+		return
 	}
+	err := RunCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	err := TestIPFSGateway(message.IPFSGateway)
+// Interactive runs the menu that lets the user do everything step by step
+func Interactive(gateway string) {
+	fmt.Println("Welcome to Infodump")
+
+	// Set message IPFS client to use the given IPFS node, if it is a valid link
+	u, err := url.Parse(gateway)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = TestIPFSGateway(u.String())
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	UseIPFSGateway(u.String())
 
 	// Run a loop and present a menu to the user to
-	// read messages
-	// write messages
+	// read messages and conversations
+	// write messages and replies
 	// sync messages
+	// see what was received from whom
 	// set the IPFS gateway
 	// set the database
 	// configure the followed tags
+	// remove expired messages
 	// quit the program
 	for {
+		// Remove the expired messages every now and then
+		ExpireIfDue()
 		// Check if the database is set, if so, show the followed tags
 		if DB != nil {
 			fmt.Println("Following tags:")
@@ -81,10 +101,18 @@ func main() {
 		Menu([]MenuElements{
 			{"Start OLN Listener", StartOLNListener},
 			{"Read Messages", ReadMessages},
+			{"Read Messages Nearby", ReadMessagesNearby},
+			{"Read Threads", ReadThreads},
+			{"Open Conversation", OpenConversationMenu},
+			{"Search Messages", SearchMenu},
 			{"Write Message", WriteMessage},
+			{"Reply to Message", WriteReply},
+			{"Save Message", SaveMessageMenu},
 			{"Sync Messages", SyncMenu},
+			{"Network History", NetworkHistory},
 			{"Trim Messages", TrimMessages},
 			{"Trim Database", TrimDatabase},
+			{"Expire Old Messages", ExpireOldMessages},
 			{"Settings", SettingsMenu},
 			{"Quit", func() { os.Exit(0) }},
 		})
@@ -102,6 +130,10 @@ func SettingsMenu() {
 		{"Set IPFS Gateway", SetIPFSGateway},
 		{"Set Database", SetDatabase},
 		{"Configure Followed Tags", ConfigureFollowedTags},
+		{"Configure Followed Feeds", ConfigureFollowedFeeds},
+		{"Configure Pinning", ConfigurePinning},
+		{"Configure Retention", ConfigureRetention},
+		{"Configure Identity", ConfigureIdentity},
 		{"Back", func() {}},
 	})
 }
@@ -0,0 +1,165 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// Batch is a set of messages that is published together
+// Previous is the CID of the batch that was published on the same topic before it, if any,
+// so the batches of a topic form a chain that can be followed back as far as needed
+type Batch struct {
+	Previous string `json:",omitempty"`
+	Messages *Messages
+}
+
+// dagLink is an IPLD link to another node, written in dag-json as {"/": "<cid>"}
+type dagLink struct {
+	CID string `json:"/"`
+}
+
+// batchNode is how a batch is stored as an IPLD node: every message is a node of its own,
+// and the batch links the stamps to them, so a message that is in many batches is stored once
+type batchNode struct {
+	Previous *dagLink `json:",omitempty"`
+	Messages map[string]dagLink
+}
+
+// MarshalJSON writes the messages as an object that maps the stamps to the messages, like Messages.JSON
+func (m *Messages) MarshalJSON() ([]byte, error) {
+	return m.JSON()
+}
+
+// UnmarshalJSON reads the messages as written by MarshalJSON
+func (m *Messages) UnmarshalJSON(b []byte) error {
+	msgs, err := MessagesFromJSON(b)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.msgs = msgs.msgs
+	return nil
+}
+
+// BatchFromJSON reads a batch that was added as a single JSON file
+// Before there were batches only the messages were published, those are read as a batch without a previous one
+func BatchFromJSON(jsonb []byte) (*Batch, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jsonb, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["Messages"]; !ok {
+		msgs, err := MessagesFromJSON(jsonb)
+		if err != nil {
+			return nil, err
+		}
+		return &Batch{Messages: msgs}, nil
+	}
+	batch := Batch{Messages: &Messages{}}
+	if err := json.Unmarshal(jsonb, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// BatchFromIPFS gets the batch with the given CID from the network using the transport
+// Only the messages that are not in known are fetched, the others are taken from known; known can be nil
+// Batches that were added as a JSON file, before batches were stored as IPLD nodes, are read with BatchFromJSON
+func BatchFromIPFS(t transport.Transport, cid string, known *Messages) (*Batch, error) {
+	if data, err := t.DagGet(cid); err == nil {
+		var node batchNode
+		if json.Unmarshal(data, &node) == nil && node.valid() {
+			return node.fetch(t, known)
+		}
+	}
+	r, err := t.Cat(cid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	jsonb, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return BatchFromJSON(jsonb)
+}
+
+// valid checks if the node is a batch node, and not a batch or messages that were added as a JSON file
+func (n *batchNode) valid() bool {
+	if n.Messages == nil || (n.Previous != nil && n.Previous.CID == "") {
+		return false
+	}
+	for _, link := range n.Messages {
+		if link.CID == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch gets the messages of the batch node that are not in known
+// The messages are kept under the stamps the batch links them to, use VerifyAll to check them
+func (n *batchNode) fetch(t transport.Transport, known *Messages) (*Batch, error) {
+	batch := &Batch{Messages: &Messages{msgs: make(map[string]*Message)}}
+	if n.Previous != nil {
+		batch.Previous = n.Previous.CID
+	}
+	for stamp, link := range n.Messages {
+		if known != nil {
+			if m := known.Get(stamp); m != nil {
+				batch.Messages.msgs[stamp] = m
+				continue
+			}
+		}
+		data, err := t.DagGet(link.CID)
+		if err != nil {
+			return nil, fmt.Errorf("message %s: %w", stamp, err)
+		}
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("message %s: %w", stamp, err)
+		}
+		batch.Messages.msgs[stamp] = &m
+	}
+	return batch, nil
+}
+
+// AddToIPFS stores the message as an IPLD node using the transport and returns its CID
+// The node is the same for every batch the message is in, so it is also what is pinned to keep the message
+func (m *Message) AddToIPFS(t transport.Transport) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return t.DagPut(data)
+}
+
+// AddToIPFS stores the batch on the network using the transport and returns its CID
+// Every message is put as a node of its own, and the batch as a node that links to them
+func (b *Batch) AddToIPFS(t transport.Transport) (string, error) {
+	node := batchNode{Messages: make(map[string]dagLink)}
+	if b.Previous != "" {
+		node.Previous = &dagLink{b.Previous}
+	}
+	var err error
+	b.Messages.Each(func(m *Message) {
+		if err != nil {
+			return
+		}
+		var cid string
+		cid, err = m.AddToIPFS(t)
+		node.Messages[m.Stamp()] = dagLink{cid}
+	})
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		return "", err
+	}
+	return t.DagPut(data)
+}
@@ -0,0 +1,89 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Versions of the format that is hashed to create the stamp of a message
+// Version 0 is the original format: the message, timestamp and nonce concatenated as decimal strings
+// Version 1 is the canonical encoding described at Message.Encode
+const (
+	VersionLegacy  = 0
+	VersionV1      = 1
+	CurrentVersion = VersionV1
+)
+
+// Field tags used in the canonical encoding
+// Fields are always written in ascending order of their tag, the nonce always comes last
+// so the encoding of everything before it can be reused while searching for a proof of work
+// The signature comes right before the nonce and covers every field with a lower tag
+const (
+	fieldMessage   byte = 0x01
+	fieldTimestamp byte = 0x02
+	fieldPublicKey byte = 0x03
+	fieldParent    byte = 0x04
+	fieldSignature byte = 0xfe
+	fieldNonce     byte = 0xff
+)
+
+// Encode returns the canonical encoding of a message that is hashed to create its stamp
+// The encoding starts with the version byte, followed by every field as a tag byte,
+// the length of the value as an unsigned varint and the value itself
+// Integers are encoded as 8 byte big endian values
+// New optional fields get a new tag and are left out when empty, so older stamps stay valid
+func (m *Message) Encode() []byte {
+	return appendNonce(m.encodePrefix(), m.Nonce)
+}
+
+// encodePrefix returns the canonical encoding of the message without the nonce
+func (m *Message) encodePrefix() []byte {
+	b := m.encodeSigned()
+	if len(m.Signature) > 0 {
+		b = appendField(b, fieldSignature, m.Signature)
+	}
+	return b
+}
+
+// encodeSigned returns the canonical encoding of the part of the message that is covered by the signature
+func (m *Message) encodeSigned() []byte {
+	b := make([]byte, 0, len(m.Message)+len(m.PublicKey)+len(m.Signature)+len(m.Parent)+48)
+	b = append(b, byte(m.Version))
+	b = appendField(b, fieldMessage, []byte(m.Message))
+	b = appendInt(b, fieldTimestamp, m.Timestamp)
+	if len(m.PublicKey) > 0 {
+		b = appendField(b, fieldPublicKey, m.PublicKey)
+	}
+	if m.Parent != "" {
+		b = appendField(b, fieldParent, []byte(m.Parent))
+	}
+	return b
+}
+
+// appendNonce adds the nonce as the last field to an encoded prefix
+func appendNonce(b []byte, nonce int) []byte {
+	return appendInt(b, fieldNonce, int64(nonce))
+}
+
+// appendField appends a tag, the length of the value and the value itself
+func appendField(b []byte, tag byte, value []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(value)))
+	b = append(b, tag)
+	b = append(b, l[:n]...)
+	return append(b, value...)
+}
+
+// appendInt appends an integer field as an 8 byte big endian value
+func appendInt(b []byte, tag byte, value int64) []byte {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], uint64(value))
+	return appendField(b, tag, v[:])
+}
+
+// hashV0 is the original hash of a message: SHA256 of the message plus the timestamp plus the nonce as decimal strings
+// It is ambiguous and only kept to verify messages that were created with VersionLegacy
+func (m *Message) hashV0() [32]byte {
+	return sha256.Sum256([]byte(m.Message + fmt.Sprintf("%d", m.Timestamp) + fmt.Sprintf("%d", m.Nonce)))
+}
@@ -0,0 +1,194 @@
+package message
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// geohashAlphabet is the base 32 alphabet of geohashes, it leaves out a, i, l and o
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geoPrefix marks the name of a location tag as a geohash, like ~geo:u173z
+const geoPrefix = "geo:"
+
+// MaxGeoPrecision is the length of the longest geohash prefix that location tags are published on
+const MaxGeoPrecision = 6
+
+// PointPrecision is the length of the geohash a latitude and longitude in a message are turned into,
+// which is precise to a few meters
+const PointPrecision = 9
+
+// MaxGeohashLength is the length of the most precise geohash, a few centimeters wide,
+// longer geohashes in location tags are cut off there
+const MaxGeohashLength = 12
+
+// earthRadius is the mean radius of the earth in km
+const earthRadius = 6371.0
+
+// latLonPattern matches a latitude and longitude in degrees, like 52.3676,4.9041
+var latLonPattern = regexp.MustCompile(`^[-+]?\d{1,2}(\.\d+)?,[-+]?\d{1,3}(\.\d+)?`)
+
+// Point is a place on earth, in degrees
+type Point struct {
+	Lat, Lon float64
+}
+
+// ParsePoint reads a place as a user types it, as a geohash, like u15pm or geo:u15pm,
+// or as latitude and longitude, like 52.37,4.89
+// A geohash stands for the center of its cell
+func ParsePoint(s string) (Point, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "~")
+	if hasGeoPrefix(s) {
+		s = s[len(geoPrefix):]
+	}
+	if isLatLon(s) {
+		parts := strings.Split(s, ",")
+		lat, err1 := strconv.ParseFloat(parts[0], 64)
+		lon, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+			return Point{}, false
+		}
+		return Point{lat, lon}, true
+	}
+	return DecodeGeohash(strings.ToLower(s))
+}
+
+// isLatLon checks if s is a latitude and longitude and nothing else
+func isLatLon(s string) bool {
+	match := latLonPattern.FindString(s)
+	return match != "" && match == s
+}
+
+// IsGeohash checks if s is a geohash, which means it only has characters of the geohash alphabet
+func IsGeohash(s string) bool {
+	return s != "" && strings.Trim(s, geohashAlphabet) == ""
+}
+
+// hasGeoPrefix checks if s starts with the geo: marker of geohashes, in any case
+func hasGeoPrefix(s string) bool {
+	return len(s) >= len(geoPrefix) && strings.EqualFold(s[:len(geoPrefix)], geoPrefix)
+}
+
+// GeohashTag returns the location tag of a geohash, like ~geo:u173z
+func GeohashTag(hash string) Tag {
+	return Tag{Location, geoPrefix + hash}
+}
+
+// Geohash encodes the point as a geohash of the given length
+// Every character halves the cell five times, alternating between longitude and latitude
+func (p Point) Geohash(precision int) string {
+	lat := [2]float64{-90, 90}
+	lon := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true
+	bits, value := 0, 0
+	for len(hash) < precision {
+		rng, v := &lat, p.Lat
+		if even {
+			rng, v = &lon, p.Lon
+		}
+		mid := (rng[0] + rng[1]) / 2
+		value <<= 1
+		if v >= mid {
+			value |= 1
+			rng[0] = mid
+		} else {
+			rng[1] = mid
+		}
+		even = !even
+		bits++
+		if bits == 5 {
+			hash = append(hash, geohashAlphabet[value])
+			bits, value = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// DecodeGeohash returns the center of the cell of the geohash
+func DecodeGeohash(hash string) (Point, bool) {
+	if !IsGeohash(hash) {
+		return Point{}, false
+	}
+	lat := [2]float64{-90, 90}
+	lon := [2]float64{-180, 180}
+	even := true
+	for _, c := range hash {
+		value := strings.IndexRune(geohashAlphabet, c)
+		for bit := 4; bit >= 0; bit-- {
+			rng := &lat
+			if even {
+				rng = &lon
+			}
+			mid := (rng[0] + rng[1]) / 2
+			if value&(1<<bit) != 0 {
+				rng[0] = mid
+			} else {
+				rng[1] = mid
+			}
+			even = !even
+		}
+	}
+	return Point{(lat[0] + lat[1]) / 2, (lon[0] + lon[1]) / 2}, true
+}
+
+// Distance returns the distance between two points in km, along the surface of the earth
+func (p Point) Distance(q Point) float64 {
+	rad := math.Pi / 180
+	dLat := (q.Lat - p.Lat) * rad
+	dLon := (q.Lon - p.Lon) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(p.Lat*rad)*math.Cos(q.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geohashWidths are the approximate widths in km of the cells of geohashes of 1 to MaxGeoPrecision characters
+var geohashWidths = [MaxGeoPrecision]float64{5000, 1250, 156, 39, 4.9, 1.2}
+
+// GeohashPrecision returns the length of the longest geohash whose cell is still at least km wide,
+// so following that cell covers an area of that size
+// A place close to the border of a cell is not covered in every direction, the cell is the best fit
+func GeohashPrecision(km float64) int {
+	precision := 1
+	for precision < MaxGeoPrecision && geohashWidths[precision] >= km {
+		precision++
+	}
+	return precision
+}
+
+// Geohash returns the geohash of a location tag, if it is one
+// Only a tag with the geo: marker is a geohash, a place name like ~utrecht is not, even if it could be one
+func (t Tag) Geohash() (string, bool) {
+	if t.Kind != Location || !strings.HasPrefix(t.Name, geoPrefix) || !IsGeohash(t.Name[len(geoPrefix):]) {
+		return "", false
+	}
+	return t.Name[len(geoPrefix):], true
+}
+
+// Points returns the places the message is tagged with
+func (m *Message) Points() []Point {
+	var points []Point
+	for _, tag := range m.Tags() {
+		if hash, ok := tag.Geohash(); ok {
+			p, _ := DecodeGeohash(hash)
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// Near returns the messages that are tagged with a place at most km away from p
+func (m *Messages) Near(p Point, km float64) *Messages {
+	near := &Messages{}
+	m.Each(func(msg *Message) {
+		for _, q := range msg.Points() {
+			if p.Distance(q) <= km {
+				near.Add(msg)
+				return
+			}
+		}
+	})
+	return near
+}
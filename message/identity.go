@@ -0,0 +1,98 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Identity is an optional keypair that can be used to sign messages
+// There are no accounts on Infodump, an identity is nothing more than a key that people can recognize
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewIdentity generates a new random identity
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// LoadIdentity reads an identity from a file written by Identity.Save
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("reading identity %s: %w", path, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("reading identity %s: key has the wrong size", path)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &Identity{PublicKey: priv.Public().(ed25519.PublicKey), PrivateKey: priv}, nil
+}
+
+// Save writes the private key seed of the identity as hex to a file only readable by the user
+func (id *Identity) Save(path string) error {
+	return os.WriteFile(path, []byte(hex.EncodeToString(id.PrivateKey.Seed())+"\n"), 0600)
+}
+
+// Fingerprint returns the short fingerprint of the identity, see Fingerprint
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.PublicKey)
+}
+
+// Sign sets the public key of the identity on the message and signs it
+// Signing has to happen before the proof of work, as the stamp covers the signature
+func (id *Identity) Sign(m *Message) {
+	m.PublicKey = append([]byte(nil), id.PublicKey...)
+	m.Signature = ed25519.Sign(id.PrivateKey, m.encodeSigned())
+}
+
+// Fingerprint returns a short human readable fingerprint of a public key: the first 8 bytes of its SHA256 hash in hex
+func Fingerprint(pub []byte) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:8])
+}
+
+// Signed reports whether the message carries a signature
+func (m *Message) Signed() bool {
+	return len(m.PublicKey) > 0 || len(m.Signature) > 0
+}
+
+// Author returns the fingerprint of the key that signed the message, or "anonymous" if it isn't signed
+func (m *Message) Author() string {
+	if !m.Signed() {
+		return "anonymous"
+	}
+	return Fingerprint(m.PublicKey)
+}
+
+// VerifySignature checks the signature of a signed message
+// Unsigned messages are accepted as they are
+func (m *Message) VerifySignature() error {
+	if !m.Signed() {
+		return nil
+	}
+	if m.Version == VersionLegacy {
+		return fmt.Errorf("legacy messages cannot be signed")
+	}
+	if len(m.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key has the wrong size")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(m.PublicKey), m.encodeSigned(), m.Signature) {
+		return fmt.Errorf("invalid signature by %s", m.Author())
+	}
+	return nil
+}
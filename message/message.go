@@ -2,49 +2,54 @@ package message
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
-	"math"
 	"math/bits"
 	"sort"
 	"sync"
 	"time"
 
-	ipfs "github.com/ipfs/go-ipfs-api"
+	"git.kiefte.eu/lapingvino/infodump/transport"
 )
 
-var IPFSGateway = "http://localhost:5001" // IPFS Gateway used to connect to the IPFS daemon
-
-// Set up an IPFS instance based on the IPFSGateway
-func InitIPFS() *ipfs.Shell {
-	return ipfs.NewShell(IPFSGateway)
-}
-
 // Messages on Infodump use a "stamp" using the hashcash algorithm to prevent spam and enable storing messages by importance
 // The Message type contains the message itself and a nonce that is used to verify the stamp
+// Version selects the format that is hashed, see Message.Encode
+// PublicKey and Signature are optional and identify the author, see Identity
+// Parent is the stamp of the message this message replies to, empty if it starts a new conversation
 type Message struct {
+	Version   int `json:",omitempty"`
 	Message   string
 	Timestamp int64
+	Parent    string `json:",omitempty"`
+	PublicKey []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
 	Nonce     int
 }
 
-// String method for Message: "Message *hash* sent at *human readable timestamp* with nonce *nonce*:\n*message*"
+// String method for Message: "Message *hash* sent at *human readable timestamp* by *author* with nonce *nonce*:\n*message*"
+// Replies mention the message they reply to: "Message *hash* sent at ... in reply to *parent*:\n*message*"
 func (m *Message) String() string {
-	return fmt.Sprintf("Message %x sent at %s with nonce %d:\n%s", m.Hash(), time.Unix(m.Timestamp, 0).Format(time.RFC3339), m.Nonce, m.Message)
+	var reply string
+	if m.Parent != "" {
+		reply = " in reply to " + m.Parent
+	}
+	return fmt.Sprintf("Message %x sent at %s by %s with nonce %d%s:\n%s", m.Hash(), time.Unix(m.Timestamp, 0).Format(time.RFC3339), m.Author(), m.Nonce, reply, m.Message)
 }
 
 // SortNum of a Message returns a number that can be used to sort messages by importance
-// The number is calculated by taking the timestamp of the message and
-// adding an importance factor of 2^(leading zeros of hash / 8) to it
+// The number is the time, in Unix seconds, until which the message is more important than a message
+// without proof of work that is written at that time, according to the DefaultRanker
+// So for a message without proof of work it is its timestamp, and proof of work moves it into the future
+// It doesn't change over time, so it can be stored and compared with the current time
 // If the timestamp is in the future, return 0 instead so the message will be discarded unless there are almost no messages
 func (m *Message) SortNum() int64 {
 	if m.Timestamp > time.Now().Unix() {
 		return 0
 	}
-	importance := math.Pow(2, float64(CountLeadingZeroes(m.Hash()))/8)
-	return m.Timestamp + int64(importance)
+	return DefaultRanker.Expiry(m, 1).Unix()
 }
 
 // MessageList returns a slice of Messages sorted by importance
@@ -64,36 +69,20 @@ func (m *Messages) MessageList() []*Message {
 }
 
 // Proof of Work: Find the nonce for a message by hashing the message and checking for at least n initial zeroes in the binary representation of the resulting hash
-// If it takes too long, return an error
+// The search runs on all CPUs, see Solver. If it takes too long, return ErrTimeout
 func (msg *Message) ProofOfWork(n int, timeout time.Duration) error {
-	// Create a local copy of the message and start counting
-	m := *msg
-	m.Nonce = 0
-	start := time.Now()
-	// Loop until we find a nonce that satisfies the proof of work
-	// If the nonce is not found within the timeout, return an error
-	for {
-		// Increment the nonce and hash the message
-		m.Nonce++
-		hash := m.Hash()
-		// If the hash has at least n initial zeroes, we have found a valid nonce
-		if CountLeadingZeroes(hash) >= n {
-			break
-		}
-		// If the nonce is not found within the timeout, return an error
-		if time.Since(start) > timeout {
-			return fmt.Errorf("proof of work timed out")
-		}
-	}
-	// Set the message to the local copy
-	*msg = m
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return msg.ProofOfWorkContext(ctx, n)
 }
 
-// Get the SHA256 hash of a message plus the timestamp plus the nonce as a byte slice
+// Get the SHA256 hash of the canonical encoding of the message as a byte slice
+// Messages with VersionLegacy are hashed the original way
 func (m *Message) Hash() [32]byte {
-	hash := sha256.Sum256([]byte(m.Message + fmt.Sprintf("%d", m.Timestamp) + fmt.Sprintf("%d", m.Nonce)))
-	return hash
+	if m.Version == VersionLegacy {
+		return m.hashV0()
+	}
+	return sha256.Sum256(m.Encode())
 }
 
 // Bitwise count leading zeroes in a byte slice
@@ -124,7 +113,7 @@ func (m *Message) Lead() int {
 }
 
 func New(msg string, n int, timestamp int64, timeout time.Duration) (*Message, error) {
-	m := Message{Message: msg, Timestamp: timestamp}
+	m := Message{Version: CurrentVersion, Message: msg, Timestamp: timestamp}
 	err := m.ProofOfWork(n, timeout)
 	return &m, err
 }
@@ -135,25 +124,14 @@ type Messages struct {
 	msgs map[string]*Message
 }
 
-// MessagesFromIPFS takes a CID and returns a Messages map
-func MessagesFromIPFS(cid string) (*Messages, error) {
-	emptyMsgs := Messages{msgs: make(map[string]*Message)}
-	// Create an IPFS instance based on the IPFSGateway
-	myIPFS := ipfs.NewShell(IPFSGateway)
-	// Get the JSON from IPFS
-	jsonr, err := myIPFS.Cat(cid)
-	if err != nil {
-		return &emptyMsgs, err
-	}
-	jsonb, err := io.ReadAll(jsonr)
-	if err != nil {
-		return &emptyMsgs, err
-	}
+// MessagesFromJSON takes the JSON representation of a Messages map as created by Messages.JSON and returns the Messages map
+// The messages are kept under the stamps as they appear in the JSON, use VerifyAll to check them
+func MessagesFromJSON(jsonb []byte) (*Messages, error) {
 	// Unmarshal the JSON into a Messages map
 	var messages Messages
-	err = json.Unmarshal(jsonb, &(messages.msgs))
+	err := json.Unmarshal(jsonb, &(messages.msgs))
 	if err != nil {
-		return &emptyMsgs, err
+		return &Messages{msgs: make(map[string]*Message)}, err
 	}
 	return &messages, nil
 }
@@ -215,6 +193,13 @@ func (m *Messages) JSON() ([]byte, error) {
 	return json.Marshal(m.msgs)
 }
 
+// Len returns the number of messages in the Messages map
+func (m *Messages) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.msgs)
+}
+
 // Do something with each message in the Messages map
 func (m *Messages) Each(f func(msg *Message)) {
 	m.lock.RLock()
@@ -227,20 +212,19 @@ func (m *Messages) Each(f func(msg *Message)) {
 	}
 }
 
-// Add the messages as a JSON object to IPFS
-func (m *Messages) AddToIPFS() (string, error) {
+// Add the messages as a JSON object to IPFS using the transport
+func (m *Messages) AddToIPFS(t transport.Transport) (string, error) {
 	json, err := m.JSON()
 	if err != nil {
 		return "", err
 	}
-	return AddJSONToIPFS(json)
+	return AddJSONToIPFS(t, json)
 }
 
-func AddJSONToIPFS(json []byte) (string, error) {
-	// Create an IPFS instance based on the IPFSGateway
-	myIPFS := ipfs.NewShell(IPFSGateway)
+// AddJSONToIPFS adds JSON to IPFS using the transport and returns the CID
+func AddJSONToIPFS(t transport.Transport, json []byte) (string, error) {
 	// Turn the JSON into a Reader and add it to IPFS
-	cid, err := myIPFS.Add(bytes.NewReader(json))
+	cid, err := t.Add(bytes.NewReader(json))
 	if err != nil {
 		return "", err
 	}
@@ -2,10 +2,17 @@
 package message_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
 	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
 )
 
 // Test if creating a proof of work of 16 leading zeros finishes in 10 seconds
@@ -16,3 +23,536 @@ func TestMessageTimeout(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Test that VerifyAll keeps valid messages and drops forged, weak and future messages
+func TestVerifyAll(t *testing.T) {
+	now := time.Now().Unix()
+	good, err := message.New("good", 8, now, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak := message.Message{Message: "weak", Timestamp: now}
+	future, err := message.New("future", 8, now+3600, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := message.New("forged", 8, now, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without work a stamp can still happen to be strong, so find a nonce that gives no lead at all
+	for weak.Lead() != 0 {
+		weak.Nonce++
+	}
+	// Build the JSON by hand so the forged message can be put under the wrong stamp
+	forgedStamp := good.Stamp()[:8] + forged.Stamp()[8:]
+	batch := map[string]*message.Message{
+		good.Stamp():   good,
+		weak.Stamp():   &weak,
+		future.Stamp(): future,
+		forgedStamp:    forged,
+	}
+	jsonb, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := message.MessagesFromJSON(jsonb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, report := message.DefaultPolicy.VerifyAll(msgs)
+	if report.Accepted != 1 || len(report.Rejected) != 3 {
+		t.Fatalf("expected 1 accepted and 3 rejected, got %s", report)
+	}
+	if list := valid.MessageList(); len(list) != 1 || list[0].Message != "good" {
+		t.Errorf("expected only the good message to be kept, got %v", list)
+	}
+}
+
+// Test that the policy limits are applied
+func TestValidatePolicy(t *testing.T) {
+	m, err := message.New("a message that is too long", 4, time.Now().Unix(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := message.Policy{MinLead: 4, MaxSize: 8, MaxSkew: time.Minute}
+	if err := p.Validate(m.Stamp(), m); err == nil {
+		t.Error("expected message above MaxSize to be rejected")
+	}
+	p.MaxSize = 0
+	if err := p.Validate(m.Stamp(), m); err != nil {
+		t.Error("expected message to be accepted without a size limit:", err)
+	}
+	for _, version := range []int{-1, message.CurrentVersion + 1} {
+		odd := &message.Message{Version: version, Message: "odd version", Timestamp: time.Now().Unix()}
+		if err := odd.ProofOfWork(4, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Validate(odd.Stamp(), odd); err == nil {
+			t.Errorf("expected a message with version %d to be rejected", version)
+		}
+	}
+}
+
+// Test that the canonical encoding keeps fields apart where the legacy format runs them together
+func TestEncodingUnambiguous(t *testing.T) {
+	a := message.Message{Message: "ab", Timestamp: 12, Nonce: 3}
+	b := message.Message{Message: "ab1", Timestamp: 2, Nonce: 3}
+	if a.Hash() != b.Hash() {
+		t.Error("expected the legacy hashes to collide")
+	}
+	a.Version, b.Version = message.CurrentVersion, message.CurrentVersion
+	if a.Hash() == b.Hash() {
+		t.Error("expected the canonical hashes to differ")
+	}
+}
+
+// Test that legacy messages still hash the original way
+func TestLegacyHash(t *testing.T) {
+	m := message.Message{Message: "test", Timestamp: 1637000000, Nonce: 42}
+	if m.Hash() != sha256.Sum256([]byte("test163700000042")) {
+		t.Error("legacy hash changed")
+	}
+}
+
+// Test that signed messages verify and that tampering with them is detected
+func TestSignedMessage(t *testing.T) {
+	id, err := message.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := message.Message{Version: message.CurrentVersion, Message: "signed", Timestamp: time.Now().Unix()}
+	id.Sign(&m)
+	if err := m.ProofOfWork(8, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := message.Validate(m.Stamp(), &m); err != nil {
+		t.Fatal("expected signed message to be valid:", err)
+	}
+	if m.Author() != id.Fingerprint() {
+		t.Errorf("expected author %s, got %s", id.Fingerprint(), m.Author())
+	}
+	forged := m
+	forged.Message = "forged"
+	if err := forged.VerifySignature(); err == nil {
+		t.Error("expected changed message to fail signature verification")
+	}
+}
+
+// Test that an identity survives being saved and loaded
+func TestIdentitySaveLoad(t *testing.T) {
+	id, err := message.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "infodump.key")
+	if err := id.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := message.LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Fingerprint() != id.Fingerprint() {
+		t.Error("loaded identity differs from saved identity")
+	}
+}
+
+// Test that the parallel solver finds valid stamps for both legacy and current messages
+func TestSolver(t *testing.T) {
+	for _, version := range []int{message.VersionLegacy, message.CurrentVersion} {
+		m := message.Message{Version: version, Message: "solver", Timestamp: time.Now().Unix()}
+		err := message.Solver{Workers: 4}.Solve(context.Background(), &m, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Lead() < 12 {
+			t.Errorf("version %d: expected at least 12 leading zeroes, got %d", version, m.Lead())
+		}
+	}
+}
+
+// Test that the solver stops when the context is cancelled
+func TestSolverCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m := message.Message{Version: message.CurrentVersion, Message: "never", Timestamp: time.Now().Unix()}
+	var reported bool
+	s := message.Solver{Progress: func(message.Progress) { reported = true }, ProgressInterval: 10 * time.Millisecond}
+	if err := s.Solve(ctx, &m, 200); err != message.ErrTimeout {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+	if !reported {
+		t.Error("expected progress to be reported")
+	}
+}
+
+// legacyProofOfWork is the original single goroutine search, kept to compare the solver with
+func legacyProofOfWork(msg *message.Message, n int, timeout time.Duration) error {
+	m := *msg
+	m.Nonce = 0
+	start := time.Now()
+	for {
+		m.Nonce++
+		if message.CountLeadingZeroes(m.Hash()) >= n {
+			break
+		}
+		if time.Since(start) > timeout {
+			return message.ErrTimeout
+		}
+	}
+	*msg = m
+	return nil
+}
+
+const benchDifficulty = 14
+
+func BenchmarkProofOfWorkLegacy(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := message.Message{Version: message.CurrentVersion, Message: "benchmark", Timestamp: int64(i)}
+		if err := legacyProofOfWork(&m, benchDifficulty, time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProofOfWorkSingle(b *testing.B) {
+	benchmarkSolver(b, message.Solver{Workers: 1})
+}
+
+func BenchmarkProofOfWorkParallel(b *testing.B) {
+	benchmarkSolver(b, message.Solver{Workers: runtime.NumCPU()})
+}
+
+func benchmarkSolver(b *testing.B, s message.Solver) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := message.Message{Version: message.CurrentVersion, Message: "benchmark", Timestamp: int64(i)}
+		if err := s.Solve(context.Background(), &m, benchDifficulty); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Test that mining with a time budget returns the stamp it claims to have found
+func TestBestWithin(t *testing.T) {
+	m := message.Message{Version: message.CurrentVersion, Message: "budget", Timestamp: time.Now().Unix()}
+	lead, err := message.DefaultSolver.BestWithin(&m, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Lead() != lead {
+		t.Errorf("expected the message to have lead %d, got %d", lead, m.Lead())
+	}
+	if lead < 4 {
+		t.Errorf("expected 100ms of mining to reach at least 4 leading zeroes, got %d", lead)
+	}
+}
+
+// Test that the hash rate is measured and used for the estimate
+func TestHashRate(t *testing.T) {
+	rate := message.DefaultSolver.HashRate(50 * time.Millisecond)
+	if rate <= 0 {
+		t.Fatal("expected a positive hash rate")
+	}
+	if message.ExpectedDuration(20, rate) <= message.ExpectedDuration(10, rate) {
+		t.Error("expected a higher difficulty to take longer")
+	}
+}
+
+// Test that replies are covered by the stamp and end up in the right place of a thread
+func TestThreads(t *testing.T) {
+	now := time.Now().Unix()
+	root := &message.Message{Version: message.CurrentVersion, Message: "root", Timestamp: now}
+	reply := &message.Message{Version: message.CurrentVersion, Message: "reply", Timestamp: now + 1, Parent: root.Stamp()}
+	nested := &message.Message{Version: message.CurrentVersion, Message: "nested", Timestamp: now + 2, Parent: reply.Stamp()}
+	other := &message.Message{Version: message.CurrentVersion, Message: "other", Timestamp: now}
+	unparented := *reply
+	unparented.Parent = ""
+	if unparented.Stamp() == reply.Stamp() {
+		t.Error("expected the parent to be covered by the stamp")
+	}
+	msgs := message.Messages{}
+	for _, m := range []*message.Message{root, reply, nested, other} {
+		msgs.Add(m)
+	}
+	if n := msgs.ReplyCounts()[root.Stamp()]; n != 1 {
+		t.Errorf("expected 1 reply to root, got %d", n)
+	}
+	if msgs.Root(nested.Stamp()) != root.Stamp() {
+		t.Error("expected the nested reply to belong to the conversation of root")
+	}
+	thread := msgs.Thread(root.Stamp())
+	if thread.Size() != 3 || thread.Replies[0].Replies[0].Message != nested {
+		t.Error("expected root, reply and nested reply in the thread")
+	}
+	if threads := msgs.Threads(); len(threads) != 2 {
+		t.Errorf("expected 2 conversations, got %d", len(threads))
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tag := func(kind message.TagKind, name string) message.Tag {
+		return message.Tag{Kind: kind, Name: name}
+	}
+	for _, c := range []struct {
+		text string
+		tags []message.Tag
+	}{
+		{"nothing to see here", nil},
+		{"#Go and #go and #GO", []message.Tag{tag(message.Hashtag, "go")}},
+		{"Trailing punctuation: #golang, #ipfs! (#sqlite)", []message.Tag{
+			tag(message.Hashtag, "golang"), tag(message.Hashtag, "ipfs"), tag(message.Hashtag, "sqlite"),
+		}},
+		{"Unicode #Straße #STRASSE #日本語 #café", []message.Tag{
+			tag(message.Hashtag, "strasse"), tag(message.Hashtag, "日本語"), tag(message.Hashtag, "café"),
+		}},
+		// An e with a combining accent is the same as é
+		{"#cafe\u0301", []message.Tag{tag(message.Hashtag, "café")}},
+		{"Not tags: C# mail@example.com #1 # @ ~", nil},
+		{"ask @LaPingvino about @ipfs_team", []message.Tag{tag(message.Mention, "lapingvino"), tag(message.Mention, "ipfs_team")}},
+		{"meet at ~Amsterdam.", []message.Tag{tag(message.Location, "amsterdam")}},
+		{"see HTTPS://Example.COM/Some/Path?q=1.", []message.Tag{tag(message.Link, "https://example.com/Some/Path?q=1")}},
+		{"(http://example.com/wiki/Go_(language)) and http://example.com/#anchor", []message.Tag{
+			tag(message.Link, "http://example.com/wiki/Go_(language)"), tag(message.Link, "http://example.com/#anchor"),
+		}},
+		{"http:// is not a link", nil},
+		{"#one#two", []message.Tag{tag(message.Hashtag, "one")}},
+	} {
+		tags := message.ParseTags(c.text)
+		if fmt.Sprint(tags) != fmt.Sprint(c.tags) {
+			t.Errorf("ParseTags(%q) = %v, expected %v", c.text, tags, c.tags)
+		}
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	for input, expected := range map[string]string{
+		"golang":                 "#golang",
+		"#GoLang":                "#golang",
+		"@Someone":               "@someone",
+		"~Paris":                 "~paris",
+		"~Geo:U173Z":             "~geo:u173z",
+		"~geo:u173zzzzzzzzzzzzz": "~geo:u173zzzzzzzz",
+		"~geo:amsterdam":         "",
+		"https://Example.com/":   "https://example.com/",
+		"not a tag":              "",
+		"#":                      "",
+		"123":                    "",
+	} {
+		tag, ok := message.ParseTag(input)
+		if !ok && expected != "" || ok && tag.String() != expected {
+			t.Errorf("ParseTag(%q) = %v %v, expected %q", input, tag, ok, expected)
+		}
+	}
+}
+
+func TestGeohash(t *testing.T) {
+	// The example from the geohash article on Wikipedia
+	p := message.Point{Lat: 57.64911, Lon: 10.40744}
+	if hash := p.Geohash(11); hash != "u4pruydqqvj" {
+		t.Errorf("expected u4pruydqqvj, got %s", hash)
+	}
+	decoded, ok := message.DecodeGeohash("u4pruydqqvj")
+	if !ok || p.Distance(decoded) > 0.001 {
+		t.Errorf("expected the geohash to decode to %v, got %v", p, decoded)
+	}
+	if _, ok := message.DecodeGeohash("amsterdam"); ok {
+		t.Error("expected a name with letters outside the geohash alphabet not to decode")
+	}
+	amsterdam, _ := message.ParsePoint("52.3676,4.9041")
+	utrecht, _ := message.ParsePoint("~52.0907,5.1214")
+	if d := amsterdam.Distance(utrecht); d < 34 || d > 36 {
+		t.Errorf("expected Amsterdam and Utrecht to be about 35km apart, got %.1f", d)
+	}
+	for km, precision := range map[float64]int{10000: 1, 1000: 2, 100: 3, 10: 4, 2: 5, 0.1: 6} {
+		if got := message.GeohashPrecision(km); got != precision {
+			t.Errorf("expected precision %d for %vkm, got %d", precision, km, got)
+		}
+	}
+}
+
+func TestLocationTags(t *testing.T) {
+	tags := message.ParseTags("Meet me at ~52.3676,4.9041, or ~GEO:U173Z. Not ~95,200 though")
+	if len(tags) != 2 || tags[0].String() != "~geo:u173zt5p3" || tags[1].String() != "~geo:u173z" {
+		t.Fatalf("expected two geohash locations, got %v", tags)
+	}
+	topics := tags[0].Topics()
+	expected := []string{"oln-geo-u", "oln-geo-u1", "oln-geo-u17", "oln-geo-u173", "oln-geo-u173z", "oln-geo-u173zt"}
+	if fmt.Sprint(topics) != fmt.Sprint(expected) {
+		t.Errorf("expected the topics %v, got %v", expected, topics)
+	}
+	if topic := tags[0].Topic(); topic != "oln-geo-u173zt" {
+		t.Errorf("expected to follow the most precise area, got %s", topic)
+	}
+	// Place names that only use letters of the geohash alphabet are not geohashes either
+	for _, place := range message.ParseTags("~amsterdam ~utrecht ~Sydney ~berg") {
+		if _, ok := place.Geohash(); ok || place.Topic() != "oln-"+place.String() {
+			t.Errorf("expected %s to be a place name with a normal topic, got %s", place, place.Topic())
+		}
+	}
+	if points := (&message.Message{Message: "a day in ~utrecht and ~sydney"}).Points(); len(points) != 0 {
+		t.Errorf("expected place names not to be points, got %v", points)
+	}
+
+	msgs := &message.Messages{}
+	near := &message.Message{Message: "in the center ~geo:u173zq", Timestamp: 1}
+	far := &message.Message{Message: "in Utrecht ~52.0907,5.1214", Timestamp: 2}
+	nowhere := &message.Message{Message: "no place at all", Timestamp: 3}
+	msgs.Add(near)
+	msgs.Add(far)
+	msgs.Add(nowhere)
+	amsterdam, _ := message.ParsePoint("52.3676,4.9041")
+	if found := msgs.Near(amsterdam, 10).MessageList(); len(found) != 1 || found[0] != near {
+		t.Errorf("expected only the message in the center within 10km, got %v", found)
+	}
+	if found := msgs.Near(amsterdam, 50).MessageList(); len(found) != 2 {
+		t.Errorf("expected two messages within 50km, got %d", len(found))
+	}
+}
+
+// Test that batches keep their link to the previous batch, and that the plain messages of before batches are read too
+func TestBatchJSON(t *testing.T) {
+	now := time.Now().Unix()
+	msgs := &message.Messages{}
+	msgs.Add(&message.Message{Version: message.CurrentVersion, Message: "batched", Timestamp: now})
+	jsonb, err := json.Marshal(message.Batch{Previous: "QmPrevious", Messages: msgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := message.BatchFromJSON(jsonb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Previous != "QmPrevious" || batch.Messages.Len() != 1 {
+		t.Errorf("expected the batch to come back as it was, got %s", jsonb)
+	}
+
+	legacy, err := msgs.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err = message.BatchFromJSON(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Previous != "" || batch.Messages.Len() != 1 {
+		t.Errorf("expected the plain messages as a batch without a previous one, got %s", legacy)
+	}
+}
+
+// countingTransport counts the nodes that are read through it
+type countingTransport struct {
+	transport.Transport
+	gets int
+}
+
+func (t *countingTransport) DagGet(cid string) ([]byte, error) {
+	t.gets++
+	return t.Transport.DagGet(cid)
+}
+
+// Test that a message in several batches is stored once, and that known messages are not fetched
+func TestBatchDAG(t *testing.T) {
+	now := time.Now().Unix()
+	network := transport.NewNetwork()
+	shared, err := message.New("shared", 8, now, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := message.New("new", 8, now, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &message.Messages{}
+	first.Add(shared)
+	firstCID, err := (&message.Batch{Messages: first}).AddToIPFS(network.Node("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := &message.Messages{}
+	second.Add(shared)
+	second.Add(fresh)
+	secondCID, err := (&message.Batch{Previous: firstCID, Messages: second}).AddToIPFS(network.Node("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := &countingTransport{Transport: network.Node("c")}
+	batch, err := message.BatchFromIPFS(reader, secondCID, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Previous != firstCID || batch.Messages.Len() != 2 {
+		t.Errorf("expected 2 messages after %s, got %d after %s", firstCID, batch.Messages.Len(), batch.Previous)
+	}
+	// The batch and the new message
+	if reader.gets != 2 {
+		t.Errorf("expected 2 nodes to be fetched, got %d", reader.gets)
+	}
+	if valid, report := message.VerifyAll(batch.Messages); valid.Len() != 2 {
+		t.Errorf("expected the fetched messages to be valid, got %s", report)
+	}
+}
+
+// Test how long a message with proof of work stays ahead of new messages without it
+func TestDecayModel(t *testing.T) {
+	model := message.DecayModel{HalfLife: time.Hour, LeadPerDoubling: 8}
+	expected := map[int]time.Duration{
+		0:  0,
+		8:  2 * time.Hour,
+		16: 8 * time.Hour,
+		24: 24 * time.Hour,
+		32: 64 * time.Hour,
+	}
+	for lead := 0; lead <= 32; lead += 8 {
+		// A new message without proof of work has an importance of 1
+		lifetime := model.Lifetime(lead, 1)
+		t.Logf("a message with a lead of %d stays ahead of new messages without proof of work for %s", lead, lifetime)
+		if lifetime != expected[lead] {
+			t.Errorf("expected a lead of %d to stay ahead for %s, got %s", lead, expected[lead], lifetime)
+		}
+		if lead > 0 && (model.Decay(lead, lifetime-time.Minute) <= 1 || model.Decay(lead, lifetime+time.Minute) >= 1) {
+			t.Errorf("expected a lead of %d to fall behind after %s", lead, lifetime)
+		}
+	}
+	if model.Decay(16, 0) != 4 || model.Decay(16, 4*time.Hour) != 2 {
+		t.Error("expected a lead of 16 to start at 4 and halve in 4 hours")
+	}
+	if model.Lifetime(256, 1) <= 0 {
+		t.Error("expected the lifetime of a very strong message to be capped instead of overflowing")
+	}
+	// Settings that are not positive fall back to the defaults instead of keeping messages forever
+	for _, broken := range []message.DecayModel{{HalfLife: time.Hour}, {LeadPerDoubling: 8}, {HalfLife: -time.Hour, LeadPerDoubling: -8}} {
+		if broken.Lifetime(16, 1) != 8*time.Hour || broken.Decay(16, 4*time.Hour) != 2 {
+			t.Errorf("expected %+v to use the defaults, got a lifetime of %s", broken, broken.Lifetime(16, 1))
+		}
+	}
+}
+
+// withLead returns a message with exactly the given lead, so tests can count on its importance
+func withLead(text string, lead int, timestamp time.Time) *message.Message {
+	m := &message.Message{Version: message.CurrentVersion, Message: text, Timestamp: timestamp.Unix()}
+	for m.Lead() != lead {
+		m.Nonce++
+	}
+	return m
+}
+
+// Test that a strong message is ranked above a new weak one until it has decayed
+func TestRanking(t *testing.T) {
+	now := time.Now()
+	strong := withLead("strong", 16, now.Add(-7*time.Hour))
+	old := withLead("old", 16, now.Add(-9*time.Hour))
+	weak := withLead("weak", 0, now)
+	msgs := &message.Messages{}
+	for _, m := range []*message.Message{weak, old, strong} {
+		msgs.Add(m)
+	}
+	for _, list := range [][]*message.Message{msgs.MessageList(), msgs.Ranked(message.DefaultRanker, now)} {
+		if list[0] != strong || list[1] != weak || list[2] != old {
+			t.Errorf("expected strong, weak, old, got %q, %q, %q", list[0].Message, list[1].Message, list[2].Message)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package message
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Solver searches for a proof of work using several goroutines at once
+// Workers is the number of goroutines, 0 means one per CPU
+// Progress is called every ProgressInterval (default one second) while searching, it may be nil
+type Solver struct {
+	Workers          int
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+}
+
+// DefaultSolver uses all CPUs and doesn't report progress
+var DefaultSolver = Solver{}
+
+// Progress reports how a proof of work search is going
+// Best is the highest number of leading zeroes found so far
+type Progress struct {
+	Difficulty int
+	Best       int
+	Hashes     uint64
+	Elapsed    time.Duration
+}
+
+// Rate returns the number of hashes per second
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Hashes) / p.Elapsed.Seconds()
+}
+
+// Expected returns how long a search for the difficulty is expected to take in total at the current rate
+func (p Progress) Expected() time.Duration {
+	return ExpectedDuration(p.Difficulty, p.Rate())
+}
+
+// String method for Progress: "*hashes* hashes in *elapsed* (*rate* hashes/s), best *best*, expected time for difficulty *n*: *expected*"
+// The expected time is left out when there is no difficulty to aim for
+func (p Progress) String() string {
+	s := fmt.Sprintf("%d hashes in %s (%.0f hashes/s), best %d",
+		p.Hashes, p.Elapsed.Round(time.Millisecond), p.Rate(), p.Best)
+	if p.Difficulty > 0 {
+		s += fmt.Sprintf(", expected time for difficulty %d: %s", p.Difficulty, p.Expected().Round(time.Millisecond))
+	}
+	return s
+}
+
+// ExpectedHashes returns the number of hashes needed on average to find n leading zeroes
+func ExpectedHashes(n int) float64 {
+	return math.Pow(2, float64(n))
+}
+
+// ExpectedDuration returns how long it takes on average to find n leading zeroes at the given rate in hashes per second
+func ExpectedDuration(n int, rate float64) time.Duration {
+	if rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	seconds := ExpectedHashes(n) / rate
+	if seconds >= float64(math.MaxInt64)/float64(time.Second) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ErrTimeout is returned when the proof of work could not be found in time
+var ErrTimeout = errors.New("proof of work timed out")
+
+// workers returns the number of goroutines to use
+func (s Solver) workers() int {
+	if s.Workers > 0 {
+		return s.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// nonceEncoder returns the part of the hashed data before the nonce and a function that appends the nonce to it
+// Hashing the prefix plus the nonce gives the same result as Message.Hash
+func (m *Message) nonceEncoder() ([]byte, func([]byte, int) []byte) {
+	if m.Version == VersionLegacy {
+		return []byte(m.Message + strconv.FormatInt(m.Timestamp, 10)), func(b []byte, nonce int) []byte {
+			return strconv.AppendInt(b, int64(nonce), 10)
+		}
+	}
+	return m.encodePrefix(), appendNonce
+}
+
+// searchState is shared by the workers of a search
+type searchState struct {
+	hashes uint64 // first in the struct so it is aligned for atomic access
+	best   int32  // the highest lead found so far, read atomically
+	lock   sync.Mutex
+	nonce  int
+}
+
+// search hashes the message with increasing nonces until the context is done or a lead of at least stopAt is found
+// The nonce space is split over the workers, worker i tries the nonces i+1, i+1+workers, ...
+// It returns the nonce with the highest lead found, that lead (-1 if no hash was done at all) and the number of hashes done
+func (s Solver) search(ctx context.Context, msg *Message, difficulty, stopAt int) (nonce, lead int, hashes uint64) {
+	workers := s.workers()
+	prefix, encode := msg.nonceEncoder()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	state := searchState{best: -1}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			// Reuse the same buffer for every hash to avoid allocations
+			buf := make([]byte, len(prefix), len(prefix)+24)
+			copy(buf, prefix)
+			var count uint64
+			for nonce := start; ; nonce += workers {
+				hash := sha256.Sum256(encode(buf[:len(prefix)], nonce))
+				count++
+				if lead := CountLeadingZeroes(hash); int32(lead) > atomic.LoadInt32(&state.best) {
+					state.lock.Lock()
+					if int32(lead) > state.best {
+						state.nonce = nonce
+						atomic.StoreInt32(&state.best, int32(lead))
+					}
+					state.lock.Unlock()
+					if lead >= stopAt {
+						atomic.AddUint64(&state.hashes, count)
+						cancel()
+						return
+					}
+				}
+				// Only check for cancellation and update the counter every so often
+				if count == 1024 {
+					atomic.AddUint64(&state.hashes, count)
+					count = 0
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(w + 1)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	s.report(done, difficulty, &state)
+	return state.nonce, int(state.best), state.hashes
+}
+
+// Solve finds a nonce for the message so that its hash has at least n leading zeroes
+// Solve stops when the context is done and returns ErrTimeout if its deadline passed, or the error of the context otherwise
+func (s Solver) Solve(ctx context.Context, msg *Message, n int) error {
+	nonce, lead, _ := s.search(ctx, msg, n, n)
+	if lead < n {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrTimeout
+		}
+		return ctx.Err()
+	}
+	msg.Nonce = nonce
+	return nil
+}
+
+// Best keeps searching until the context is done and sets the nonce of the message to the strongest stamp found
+// This is the way to get the highest importance possible within a time budget
+// It returns the lead of the stamp, or the error of the context if nothing was found at all
+func (s Solver) Best(ctx context.Context, msg *Message) (int, error) {
+	nonce, lead, _ := s.search(ctx, msg, 0, 256)
+	if lead < 0 {
+		return 0, ctx.Err()
+	}
+	msg.Nonce = nonce
+	return lead, nil
+}
+
+// BestWithin runs Best with a time budget
+func (s Solver) BestWithin(msg *Message, budget time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+	return s.Best(ctx, msg)
+}
+
+// HashRate measures the number of hashes per second the solver does on this machine by searching for the given duration
+func (s Solver) HashRate(d time.Duration) float64 {
+	s.Progress = nil
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	m := Message{Version: CurrentVersion, Message: "benchmark", Timestamp: time.Now().Unix()}
+	start := time.Now()
+	_, _, hashes := s.search(ctx, &m, 0, 256)
+	return Progress{Hashes: hashes, Elapsed: time.Since(start)}.Rate()
+}
+
+// Estimate returns how long the solver is expected to take for difficulty n, based on a short measurement of the hash rate
+func (s Solver) Estimate(n int) time.Duration {
+	return ExpectedDuration(n, s.HashRate(200*time.Millisecond))
+}
+
+// report calls the Progress function every ProgressInterval until done is closed
+func (s Solver) report(done chan struct{}, n int, state *searchState) {
+	if s.Progress == nil {
+		<-done
+		return
+	}
+	interval := s.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.Progress(Progress{
+				Difficulty: n,
+				Best:       int(atomic.LoadInt32(&state.best)),
+				Hashes:     atomic.LoadUint64(&state.hashes),
+				Elapsed:    time.Since(start),
+			})
+		}
+	}
+}
+
+// ProofOfWorkContext finds the nonce for a message with the DefaultSolver, see Solver.Solve
+func (msg *Message) ProofOfWorkContext(ctx context.Context, n int) error {
+	return DefaultSolver.Solve(ctx, msg, n)
+}
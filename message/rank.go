@@ -0,0 +1,97 @@
+package message
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Ranker decides how important messages are, so the most important ones are shown first and kept longest
+type Ranker interface {
+	// Importance returns how important the message is at the given time,
+	// a message without proof of work is 1 when it is written
+	Importance(m *Message, now time.Time) float64
+	// Expiry returns the time from which the message is less important than min
+	// Importance only goes down with time, so until then the message is at least as important as min
+	Expiry(m *Message, min float64) time.Time
+}
+
+// DecayModel is a Ranker where proof of work makes a message both more important and last longer:
+// a message starts with an importance of 2^(lead/LeadPerDoubling) and halves in importance every half life,
+// which is HalfLife for a message without proof of work and doubles with every LeadPerDoubling bits of lead
+// So with the defaults a message with a lead of 16 starts 4 times as important as one without proof of work,
+// halves every 4 hours, and stays ahead of new messages without proof of work for 8 hours
+// A HalfLife or LeadPerDoubling that is not positive would make messages last forever, the default is used instead
+type DecayModel struct {
+	HalfLife        time.Duration
+	LeadPerDoubling float64
+}
+
+// DefaultHalfLife and DefaultLeadPerDoubling are the settings of DefaultRanker
+const (
+	DefaultHalfLife        = time.Hour
+	DefaultLeadPerDoubling = 8
+)
+
+// DefaultRanker is the Ranker that SortNum, and so MessageList and Trim, use
+var DefaultRanker Ranker = DecayModel{HalfLife: DefaultHalfLife, LeadPerDoubling: DefaultLeadPerDoubling}
+
+// withDefaults returns the model with the defaults for the settings that are not positive
+func (d DecayModel) withDefaults() DecayModel {
+	if d.HalfLife <= 0 {
+		d.HalfLife = DefaultHalfLife
+	}
+	if !(d.LeadPerDoubling > 0) {
+		d.LeadPerDoubling = DefaultLeadPerDoubling
+	}
+	return d
+}
+
+// Decay returns the importance of a message with the given lead at the given age
+func (d DecayModel) Decay(lead int, age time.Duration) float64 {
+	d = d.withDefaults()
+	doublings := float64(lead) / d.LeadPerDoubling
+	halfLife := d.HalfLife.Seconds() * math.Pow(2, doublings)
+	return math.Pow(2, doublings-age.Seconds()/halfLife)
+}
+
+// Lifetime returns how long a message with the given lead is at least as important as min
+// It is 0 if the message is less important than min from the start, and capped at the longest time.Duration
+func (d DecayModel) Lifetime(lead int, min float64) time.Duration {
+	d = d.withDefaults()
+	doublings := float64(lead) / d.LeadPerDoubling
+	halfLife := d.HalfLife.Seconds() * math.Pow(2, doublings)
+	seconds := (doublings - math.Log2(min)) * halfLife
+	if seconds <= 0 {
+		return 0
+	}
+	if seconds >= float64(math.MaxInt64)/float64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Importance returns the importance of the message at the given time, see Decay
+// A message from the future is not important at all
+func (d DecayModel) Importance(m *Message, now time.Time) float64 {
+	age := now.Sub(time.Unix(m.Timestamp, 0))
+	if age < 0 {
+		return 0
+	}
+	return d.Decay(m.Lead(), age)
+}
+
+// Expiry returns the time from which the message is less important than min, see Lifetime
+func (d DecayModel) Expiry(m *Message, min float64) time.Time {
+	return time.Unix(m.Timestamp, 0).Add(d.Lifetime(m.Lead(), min))
+}
+
+// Ranked returns the messages sorted by their importance at the given time according to the ranker,
+// most important first
+func (m *Messages) Ranked(r Ranker, now time.Time) []*Message {
+	msgs := m.MessageList()
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return r.Importance(msgs[i], now) > r.Importance(msgs[j], now)
+	})
+	return msgs
+}
@@ -0,0 +1,251 @@
+package message
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// TagKind tells what a tag refers to, it is written as the first character of the tag
+type TagKind int
+
+const (
+	// Hashtag is a topic, like #golang
+	Hashtag TagKind = iota + 1
+	// Mention is a person, like @lapingvino
+	Mention
+	// Link is a web address, like https://example.com/
+	Link
+	// Location is a place, like ~amsterdam, or a geohash like ~geo:u173z
+	// A geohash needs the geo: marker, since many place names, like ~utrecht, only use letters of the geohash alphabet
+	// A latitude and longitude like ~52.37,4.89 is turned into a geohash
+	Location
+)
+
+// tagPrefixes maps the first character of a tag to its kind, links are recognized by their scheme instead
+var tagPrefixes = map[rune]TagKind{
+	'#': Hashtag,
+	'@': Mention,
+	'~': Location,
+}
+
+// linkSchemes are the schemes a link tag can start with
+var linkSchemes = []string{"https://", "http://"}
+
+// trailingPunctuation is taken off the end of links, since it is more likely to belong to the sentence
+const trailingPunctuation = ".,;:!?'\")]}"
+
+func (k TagKind) String() string {
+	switch k {
+	case Hashtag:
+		return "hashtag"
+	case Mention:
+		return "mention"
+	case Link:
+		return "link"
+	case Location:
+		return "location"
+	}
+	return "unknown"
+}
+
+// Tag is a normalized tag from a message
+// Name is the tag without its prefix, for links it is the whole address
+type Tag struct {
+	Kind TagKind
+	Name string
+}
+
+// String returns the tag as it is written, e.g. #golang
+func (t Tag) String() string {
+	for prefix, kind := range tagPrefixes {
+		if kind == t.Kind {
+			return string(prefix) + t.Name
+		}
+	}
+	return t.Name
+}
+
+// Topic returns the PubSub topic to follow the tag on
+// For a geohash that is the topic of its area, see Topics
+func (t Tag) Topic() string {
+	if hash, ok := t.Geohash(); ok {
+		if len(hash) > MaxGeoPrecision {
+			hash = hash[:MaxGeoPrecision]
+		}
+		return "oln-geo-" + hash
+	}
+	return "oln-" + t.String()
+}
+
+// Topics returns the PubSub topics messages with the tag are published on
+// A message with a geohash is published on the topics of all areas it is in, from 5000km wide down
+// to MaxGeoPrecision, so it reaches everyone who follows an area around it, however large
+func (t Tag) Topics() []string {
+	hash, ok := t.Geohash()
+	if !ok {
+		return []string{t.Topic()}
+	}
+	var topics []string
+	for precision := 1; precision <= len(hash) && precision <= MaxGeoPrecision; precision++ {
+		topics = append(topics, "oln-geo-"+hash[:precision])
+	}
+	return topics
+}
+
+// Tags returns the tags in the message, see ParseTags
+func (m *Message) Tags() []Tag {
+	return ParseTags(m.Message)
+}
+
+// ParseTags finds the hashtags, mentions, links and locations in a text
+// A tag has to start at the beginning of a word, so e-mail addresses and C# are not tags
+// The tags are normalized, see NormalizeTag, and each tag is returned once, in the order they appear
+func ParseTags(text string) []Tag {
+	var tags []Tag
+	seen := make(map[Tag]bool)
+	previous := ' '
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		consumed := text[i : i+size]
+		if !isWordRune(previous) {
+			var tag Tag
+			if link := parseLink(text[i:]); link != "" {
+				tag, consumed = Tag{Link, link}, link
+			} else if kind, ok := tagPrefixes[r]; ok {
+				name := wordAt(text[i+size:])
+				if kind == Location {
+					if latLonPattern.MatchString(text[i+size:]) {
+						name = latLonPattern.FindString(text[i+size:])
+					} else if hasGeoPrefix(text[i+size:]) {
+						name = text[i+size:i+size+len(geoPrefix)] + wordAt(text[i+size+len(geoPrefix):])
+					}
+				}
+				tag, consumed = Tag{kind, name}, text[i:i+size+len(name)]
+			}
+			if tag, ok := NormalizeTag(tag); ok && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+		previous, _ = utf8.DecodeLastRuneInString(consumed)
+		i += len(consumed)
+	}
+	return tags
+}
+
+// ParseTag reads a single tag as a user would type it to follow it,
+// a word without a prefix is taken to be a hashtag
+func ParseTag(s string) (Tag, bool) {
+	s = strings.TrimSpace(s)
+	if parseLink(s) != "" {
+		return NormalizeTag(Tag{Link, s})
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if kind, ok := tagPrefixes[r]; ok {
+		return NormalizeTag(Tag{kind, s[size:]})
+	}
+	return NormalizeTag(Tag{Hashtag, s})
+}
+
+// NormalizeTag brings a tag in the form it is compared and stored in:
+// names are in Unicode normal form NFC and case folded, so #Straße and #STRASSE are the same tag,
+// and links have a lower case scheme and host and no trailing punctuation
+// It returns false if the result is not a valid tag, like an empty name or a hashtag of only digits
+func NormalizeTag(t Tag) (Tag, bool) {
+	switch t.Kind {
+	case Link:
+		link := parseLink(t.Name)
+		if link != t.Name {
+			return t, false
+		}
+		scheme := strings.Index(link, "://") + len("://")
+		host := strings.IndexAny(link[scheme:], "/?#")
+		if host < 0 {
+			host = len(link) - scheme
+		}
+		if host == 0 {
+			return t, false
+		}
+		return Tag{Link, strings.ToLower(link[:scheme+host]) + link[scheme+host:]}, true
+	case Hashtag, Mention, Location:
+		if t.Kind == Location && isLatLon(t.Name) {
+			p, ok := ParsePoint(t.Name)
+			if !ok {
+				return t, false
+			}
+			return GeohashTag(p.Geohash(PointPrecision)), true
+		}
+		if t.Kind == Location && hasGeoPrefix(t.Name) {
+			hash := strings.ToLower(t.Name[len(geoPrefix):])
+			if !IsGeohash(hash) {
+				return t, false
+			}
+			if len(hash) > MaxGeohashLength {
+				hash = hash[:MaxGeohashLength]
+			}
+			return GeohashTag(hash), true
+		}
+		name := foldCase(t.Name)
+		if name == "" || wordAt(name) != name {
+			return t, false
+		}
+		if t.Kind == Hashtag && strings.IndexFunc(name, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+			return t, false
+		}
+		return Tag{t.Kind, name}, true
+	}
+	return t, false
+}
+
+// foldCase brings text in NFC and folds the case, so text that only differs in case compares equal
+func foldCase(s string) string {
+	return cases.Fold().String(norm.NFC.String(s))
+}
+
+// wordAt returns the word at the start of the text, which is what can be the name of a tag
+func wordAt(text string) string {
+	end := strings.IndexFunc(text, func(r rune) bool { return !isWordRune(r) })
+	if end < 0 {
+		return text
+	}
+	return text[:end]
+}
+
+// isWordRune checks if the rune is a letter, a digit, a combining mark or an underscore, in any script
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
+
+// parseLink returns the link at the start of the text, or an empty string if there is none
+// A link runs until the next white space, without the punctuation at its end, and a closing
+// parenthesis is only part of the link if it has a matching opening one
+func parseLink(text string) string {
+	scheme := ""
+	for _, s := range linkSchemes {
+		if len(text) >= len(s) && strings.EqualFold(text[:len(s)], s) {
+			scheme = s
+		}
+	}
+	if scheme == "" {
+		return ""
+	}
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end < 0 {
+		end = len(text)
+	}
+	link := text[:end]
+	for len(link) > 0 && strings.ContainsRune(trailingPunctuation, rune(link[len(link)-1])) {
+		if strings.HasSuffix(link, ")") && strings.Count(link, "(") >= strings.Count(link, ")") {
+			break
+		}
+		link = link[:len(link)-1]
+	}
+	if len(link) <= len(scheme) {
+		return ""
+	}
+	return link
+}
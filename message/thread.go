@@ -0,0 +1,172 @@
+package message
+
+import (
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// IsStamp checks if a string looks like the stamp of a message: a SHA256 hash in lowercase hex
+func IsStamp(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Thread is a message with the replies to it, and the replies to those, and so on
+type Thread struct {
+	Message *Message
+	Replies []*Thread
+}
+
+// Walk calls f for the message of the thread and all its replies, depth first
+// The depth of the message the thread started with is 0
+func (t *Thread) Walk(f func(depth int, msg *Message)) {
+	t.walk(0, f)
+}
+
+func (t *Thread) walk(depth int, f func(depth int, msg *Message)) {
+	f(depth, t.Message)
+	for _, r := range t.Replies {
+		r.walk(depth+1, f)
+	}
+}
+
+// Size returns the number of messages in the thread
+func (t *Thread) Size() int {
+	n := 0
+	t.Walk(func(int, *Message) { n++ })
+	return n
+}
+
+// Get returns the message with the given stamp, or nil if it is not in the Messages map
+func (m *Messages) Get(stamp string) *Message {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.msgs[stamp]
+}
+
+// Find returns the messages of which the stamp starts with the given prefix
+func (m *Messages) Find(prefix string) []*Message {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var found []*Message
+	for stamp, msg := range m.msgs {
+		if strings.HasPrefix(stamp, prefix) {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
+
+// Replies returns the direct replies to the message with the given stamp, oldest first
+func (m *Messages) Replies(stamp string) []*Message {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var replies []*Message
+	for _, msg := range m.msgs {
+		if msg.Parent == stamp {
+			replies = append(replies, msg)
+		}
+	}
+	sortByTime(replies)
+	return replies
+}
+
+// ReplyCounts maps the stamp of every message that has replies to the number of direct replies
+func (m *Messages) ReplyCounts() map[string]int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	counts := make(map[string]int)
+	for _, msg := range m.msgs {
+		if msg.Parent != "" {
+			counts[msg.Parent]++
+		}
+	}
+	return counts
+}
+
+// Root returns the stamp of the first message of the conversation the message with the given stamp is part of
+// It follows the parents as far as they are in the Messages map
+func (m *Messages) Root(stamp string) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	seen := make(map[string]bool)
+	for !seen[stamp] {
+		seen[stamp] = true
+		msg := m.msgs[stamp]
+		if msg == nil || msg.Parent == "" || m.msgs[msg.Parent] == nil {
+			break
+		}
+		stamp = msg.Parent
+	}
+	return stamp
+}
+
+// Thread returns the conversation starting at the message with the given stamp, or nil if it is not in the Messages map
+func (m *Messages) Thread(stamp string) *Thread {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	children := m.children()
+	root := m.msgs[stamp]
+	if root == nil {
+		return nil
+	}
+	return buildThread(root, stamp, children, make(map[string]bool))
+}
+
+// Threads returns all conversations in the Messages map, sorted by the importance of the message they start with
+// Replies to messages that are not in the map start a conversation of their own
+func (m *Messages) Threads() []*Thread {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	children := m.children()
+	seen := make(map[string]bool)
+	var threads []*Thread
+	for stamp, msg := range m.msgs {
+		if msg.Parent == "" || m.msgs[msg.Parent] == nil {
+			threads = append(threads, buildThread(msg, stamp, children, seen))
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].Message.SortNum() > threads[j].Message.SortNum()
+	})
+	return threads
+}
+
+// children maps the stamp of every message to its direct replies, the lock has to be held by the caller
+func (m *Messages) children() map[string][]*Message {
+	children := make(map[string][]*Message)
+	for _, msg := range m.msgs {
+		if msg.Parent != "" {
+			children[msg.Parent] = append(children[msg.Parent], msg)
+		}
+	}
+	for _, replies := range children {
+		sortByTime(replies)
+	}
+	return children
+}
+
+// buildThread builds the tree of replies below msg, seen protects against messages showing up twice
+func buildThread(msg *Message, stamp string, children map[string][]*Message, seen map[string]bool) *Thread {
+	seen[stamp] = true
+	t := &Thread{Message: msg}
+	for _, r := range children[stamp] {
+		rstamp := r.Stamp()
+		if seen[rstamp] {
+			continue
+		}
+		t.Replies = append(t.Replies, buildThread(r, rstamp, children, seen))
+	}
+	return t
+}
+
+// sortByTime sorts messages from old to new
+func sortByTime(msgs []*Message) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Timestamp < msgs[j].Timestamp
+	})
+}
@@ -0,0 +1,112 @@
+package message
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Policy describes which messages are accepted from the network
+// MinLead is the minimum number of leading zero bits the stamp needs to have
+// MaxSize is the maximum length of the message text in bytes, 0 means unlimited
+// MaxSkew is how far in the future the timestamp of a message is allowed to be
+type Policy struct {
+	MinLead int
+	MaxSize int
+	MaxSkew time.Duration
+}
+
+// DefaultPolicy is the Policy used for messages coming in from the network
+var DefaultPolicy = Policy{
+	MinLead: 8,
+	MaxSize: 64 * 1024,
+	MaxSkew: 5 * time.Minute,
+}
+
+// Validate checks a single message against the policy
+// The stamp is the key under which the message was received, it has to match the stamp of the message itself
+func (p Policy) Validate(stamp string, m *Message) error {
+	if m == nil {
+		return fmt.Errorf("empty message")
+	}
+	if m.Version < 0 || m.Version > CurrentVersion {
+		return fmt.Errorf("unknown message version %d", m.Version)
+	}
+	if stamp != m.Stamp() {
+		return fmt.Errorf("stamp %s does not match message hash %s", stamp, m.Stamp())
+	}
+	if m.Parent != "" {
+		if m.Version == VersionLegacy {
+			return fmt.Errorf("legacy messages cannot be replies")
+		}
+		if !IsStamp(m.Parent) {
+			return fmt.Errorf("parent %q is not a valid stamp", m.Parent)
+		}
+	}
+	if err := m.VerifySignature(); err != nil {
+		return err
+	}
+	if lead := m.Lead(); lead < p.MinLead {
+		return fmt.Errorf("proof of work too weak: %d leading zeroes, need %d", lead, p.MinLead)
+	}
+	if p.MaxSize > 0 && len(m.Message) > p.MaxSize {
+		return fmt.Errorf("message too large: %d bytes, maximum is %d", len(m.Message), p.MaxSize)
+	}
+	if time.Unix(m.Timestamp, 0).After(time.Now().Add(p.MaxSkew)) {
+		return fmt.Errorf("timestamp %s is too far in the future", time.Unix(m.Timestamp, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Rejection records a message that was dropped by VerifyAll and the reason why
+type Rejection struct {
+	Stamp  string
+	Reason error
+}
+
+// Report is the result of verifying a batch of messages
+type Report struct {
+	Accepted int
+	Rejected []Rejection
+}
+
+// String method for Report: "*accepted* messages accepted, *rejected* rejected" followed by a line per rejection
+func (r Report) String() string {
+	s := fmt.Sprintf("%d messages accepted, %d rejected", r.Accepted, len(r.Rejected))
+	for _, rej := range r.Rejected {
+		s += fmt.Sprintf("\n  %s: %v", rej.Stamp, rej.Reason)
+	}
+	return s
+}
+
+// VerifyAll validates every message in msgs against the policy
+// It returns a new Messages map with only the accepted messages and a report of what was dropped
+func (p Policy) VerifyAll(msgs *Messages) (*Messages, Report) {
+	valid := &Messages{msgs: make(map[string]*Message)}
+	var report Report
+	msgs.lock.RLock()
+	defer msgs.lock.RUnlock()
+	for stamp, m := range msgs.msgs {
+		if err := p.Validate(stamp, m); err != nil {
+			report.Rejected = append(report.Rejected, Rejection{Stamp: stamp, Reason: err})
+			continue
+		}
+		valid.msgs[stamp] = m
+		report.Accepted++
+	}
+	// Keep the report stable so it reads the same every time
+	sort.Slice(report.Rejected, func(i, j int) bool {
+		return report.Rejected[i].Stamp < report.Rejected[j].Stamp
+	})
+	return valid, report
+}
+
+// Validate checks a single message against the DefaultPolicy
+func Validate(stamp string, m *Message) error {
+	return DefaultPolicy.Validate(stamp, m)
+}
+
+// VerifyAll validates a batch of messages against the DefaultPolicy
+func VerifyAll(msgs *Messages) (*Messages, Report) {
+	return DefaultPolicy.VerifyAll(msgs)
+}
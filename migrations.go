@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Migration is a step that upgrades the database schema to Version
+// Up runs inside a transaction together with the update of the "schema_version" table,
+// so a migration is either applied completely or not at all
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// Migrations are all steps to get from an empty database to the current schema, in order
+// Never change a migration once it is released, add a new one instead
+// Databases created before there were migrations are at version 1 or higher, depending on the
+// columns they already have; that is why the migrations check what is already there
+var Migrations = []Migration{
+	{1, "create the tables messages and followed_tags", execAll(
+		"CREATE TABLE IF NOT EXISTS messages(hash TEXT PRIMARY KEY, message TEXT, nonce INTEGER, timestamp INTEGER)",
+		"CREATE TABLE IF NOT EXISTS followed_tags(tag TEXT)",
+	)},
+	// Messages without a version are all VersionLegacy
+	{2, "add the message version", addColumn("messages", "version", "INTEGER NOT NULL DEFAULT 0")},
+	{3, "add the author key and signature", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "public_key", "BLOB")(tx); err != nil {
+			return err
+		}
+		return addColumn("messages", "signature", "BLOB")(tx)
+	}},
+	{4, "add the parent of replies", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "parent", "TEXT")(tx); err != nil {
+			return err
+		}
+		return execAll("CREATE INDEX IF NOT EXISTS messages_parent ON messages(parent)")(tx)
+	}},
+	// The tokenizer keeps # and @ as part of words, so hashtags and mentions can be searched for as they are
+	// Only a change of the text updates the index, not the columns that trimming and saving change
+	{5, "add the full text index messages_fts", execAll(
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(message, content='messages', tokenize="unicode61 tokenchars '#@'")`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts(rowid, message) VALUES (new.rowid, new.message);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, message) VALUES ('delete', old.rowid, old.message);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF message ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, message) VALUES ('delete', old.rowid, old.message);
+			INSERT INTO messages_fts(rowid, message) VALUES (new.rowid, new.message);
+		END`,
+		// Fill the index with the messages that are already in the database
+		`INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')`,
+	)},
+	// The tags are stored in their normalized form, see message.NormalizeTag
+	// normalizeTags uses the rules of message.ParseTags at the time the migration runs, so once a version is released,
+	// a change of those rules needs a new migration that extracts the tags again, so every database ends up with the same tags
+	{6, "add the tags of the messages", func(tx *sql.Tx) error {
+		err := execAll(
+			"CREATE TABLE IF NOT EXISTS message_tags(hash TEXT NOT NULL, kind TEXT NOT NULL, tag TEXT NOT NULL, PRIMARY KEY(hash, tag))",
+			"CREATE INDEX IF NOT EXISTS message_tags_tag ON message_tags(tag)",
+			`CREATE TRIGGER IF NOT EXISTS message_tags_delete AFTER DELETE ON messages BEGIN
+				DELETE FROM message_tags WHERE hash = old.hash;
+			END`,
+		)(tx)
+		if err != nil {
+			return err
+		}
+		return normalizeTags(tx)
+	}},
+	// Every topic has a chain of batches, published_messages tells which messages are in it already
+	{7, "track the published batches", execAll(
+		"CREATE TABLE IF NOT EXISTS published_batches(cid TEXT NOT NULL, topic TEXT NOT NULL, previous TEXT, count INTEGER NOT NULL, published_at INTEGER NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS published_batches_topic ON published_batches(topic)",
+		"CREATE TABLE IF NOT EXISTS published_messages(topic TEXT NOT NULL, hash TEXT NOT NULL, cid TEXT NOT NULL, PRIMARY KEY(topic, hash))",
+	)},
+	// last_cid is the batch a feed pointed to when it was pulled last, resume_cid and resume_head are set
+	// when a pull didn't get back to it, so the next one continues there, see PullFeed
+	{8, "add the followed feeds", execAll(
+		"CREATE TABLE IF NOT EXISTS followed_feeds(name TEXT PRIMARY KEY, last_cid TEXT, resume_cid TEXT, resume_head TEXT, pulled_at INTEGER)",
+	)},
+	// pins has no foreign key on messages on purpose: a pin outlives its message until SyncPins unpins it
+	{9, "add saved messages, pins and settings", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "saved", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		return execAll(
+			"CREATE TABLE IF NOT EXISTS pins(hash TEXT PRIMARY KEY, cid TEXT NOT NULL, pinned_at INTEGER)",
+			"CREATE TABLE IF NOT EXISTS settings(key TEXT PRIMARY KEY, value TEXT)",
+		)(tx)
+	}},
+	// The index lets trimming and expiring find the least important messages that are not saved without a full scan
+	// Messages from the future get an importance of 0 until their time has come, see Importance
+	{10, "add the importance of the messages", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "importance", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		if err := execAll("CREATE INDEX IF NOT EXISTS messages_importance ON messages(saved, importance)")(tx); err != nil {
+			return err
+		}
+		return fillImportance(tx)
+	}},
+	// Messages that were stored before have no first seen time and no source
+	{11, "track when and where messages were first seen", func(tx *sql.Tx) error {
+		if err := addColumn("messages", "first_seen", "INTEGER")(tx); err != nil {
+			return err
+		}
+		return addColumn("messages", "source", "TEXT")(tx)
+	}},
+	// The batches that were announced to this node, the ones it published itself are in published_batches
+	{12, "add the received batches", execAll(
+		`CREATE TABLE IF NOT EXISTS batches(
+			cid TEXT NOT NULL, topic TEXT NOT NULL, peer TEXT NOT NULL,
+			count INTEGER, times INTEGER NOT NULL DEFAULT 1, received_at INTEGER,
+			PRIMARY KEY(cid, topic, peer)
+		)`,
+		"CREATE INDEX IF NOT EXISTS batches_received_at ON batches(received_at)",
+	)},
+}
+
+// normalizeTags extracts the tags of the messages that are already in the database, replacing the ones that were extracted before,
+// and brings the followed tags in the same form, so they match the tags of the messages
+func normalizeTags(tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM message_tags"); err != nil {
+		return err
+	}
+	texts, err := queryStrings(tx, "SELECT hash, message FROM messages")
+	if err != nil {
+		return err
+	}
+	for _, text := range texts {
+		if err := insertTags(tx, text[0], message.ParseTags(text[1])); err != nil {
+			return err
+		}
+	}
+
+	followed, err := queryStrings(tx, "SELECT DISTINCT tag FROM followed_tags")
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM followed_tags"); err != nil {
+		return err
+	}
+	for _, tag := range followed {
+		// Tags that were never valid can't match any message, so they are dropped
+		if err := followTag(tx, tag[0]); err != nil {
+			fmt.Println("Not following", tag[0], "anymore:", err)
+		}
+	}
+	return nil
+}
+
+// fillImportance computes the importance of the messages that are already in the database
+func fillImportance(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT " + messageColumns + " FROM messages")
+	if err != nil {
+		return err
+	}
+	importance := make(map[string]int64)
+	for rows.Next() {
+		hash, m, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		importance[hash] = Importance(m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for hash, value := range importance {
+		if _, err := tx.Exec("UPDATE messages SET importance = ? WHERE hash = ?", value, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryStrings returns all rows of a query with only text columns
+func queryStrings(tx *sql.Tx, query string) ([][]string, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		row := make([]string, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// execAll returns a migration step that executes the statements in order
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn returns a migration step that adds a column to a table, unless the table already has it
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		exists, err := hasColumn(tx, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+		return err
+	}
+}
+
+// hasColumn checks if the table in the database has a column with the given name
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// SchemaVersion returns the version of the schema of the database, 0 if no migrations were applied yet
+func SchemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version(version INTEGER PRIMARY KEY, description TEXT, applied_at INTEGER)")
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// Migrate upgrades the database to the latest schema by applying all Migrations it doesn't have yet
+func Migrate(db *sql.DB) error {
+	return applyMigrations(db, Migrations)
+}
+
+// applyMigrations applies the migrations with a version higher than the one of the database,
+// each in its own transaction
+func applyMigrations(db *sql.DB, migrations []Migration) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			return fmt.Errorf("migration %d is out of order", m.Version)
+		}
+		if m.Version <= current {
+			continue
+		}
+		fmt.Println("Upgrading database to version", m.Version, "-", m.Description)
+		err := applyMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("upgrading database to version %d: %w", m.Version, err)
+		}
+		current = m.Version
+	}
+	return nil
+}
+
+// applyMigration runs a single migration and records it in "schema_version" in one transaction
+func applyMigration(db *sql.DB, m Migration) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO schema_version(version, description, applied_at) VALUES(?, ?, ?)", m.Version, m.Description, time.Now().Unix())
+		return err
+	})
+}
+
+// busyTimeout makes a connection wait up to 5 seconds for another connection that is writing,
+// instead of failing right away, since listening and publishing use the database at the same time
+const busyTimeout = "busy_timeout(5000)"
+
+// databaseSource adds the busy timeout to the options of a database path, like infodump.db?_pragma=foreign_keys(1),
+// unless the path sets a busy timeout itself
+// It has to be an option and not a PRAGMA statement, since every connection of the pool needs it
+func databaseSource(path string) string {
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		// The driver reports the invalid options when the database is opened
+		return path + "?" + query
+	}
+	for _, pragma := range options["_pragma"] {
+		if strings.HasPrefix(strings.ToLower(pragma), "busy_timeout") {
+			return path + "?" + query
+		}
+	}
+	options.Add("_pragma", busyTimeout)
+	return path + "?" + options.Encode()
+}
+
+// OpenDatabase opens the database at the given path and upgrades it to the latest schema
+func OpenDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", databaseSource(path))
+	if err != nil {
+		return nil, err
+	}
+	err = Migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// createBaselineDatabase creates a database the way Infodump did before there were migrations,
+// with a single legacy message in it
+func createBaselineDatabase(t *testing.T) (string, *message.Message) {
+	path := filepath.Join(t.TempDir(), "infodump.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		"CREATE TABLE messages(hash TEXT PRIMARY KEY, message TEXT, nonce INTEGER, timestamp INTEGER)",
+		"CREATE TABLE followed_tags(tag TEXT)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &message.Message{Message: "an old message about #history", Timestamp: 1637000000, Nonce: 42}
+	_, err = db.Exec("INSERT INTO messages(hash, message, nonce, timestamp) VALUES(?,?,?,?)", m.Stamp(), m.Message, m.Nonce, m.Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO followed_tags(tag) VALUES('history')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, m
+}
+
+// Test that a database created by the original schema is upgraded without losing anything
+func TestMigrateBaseline(t *testing.T) {
+	path, old := createBaselineDatabase(t)
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := Migrations[len(Migrations)-1].Version; version != latest {
+		t.Errorf("expected schema version %d, got %d", latest, version)
+	}
+	m := GetMessagesFromDatabase(db).Get(old.Stamp())
+	if m == nil || m.Version != message.VersionLegacy || m.Stamp() != old.Stamp() {
+		t.Fatalf("expected the legacy message to survive the upgrade, got %v", m)
+	}
+	if tags := GetFollowedTags(db); len(tags) != 1 || tags[0] != "#history" {
+		t.Errorf("expected the followed tags to survive the upgrade as hashtags, got %v", tags)
+	}
+	if tagged := GetMessagesWithTag(db, "#history"); tagged.Get(old.Stamp()) == nil {
+		t.Error("expected the tags of the old message to be extracted")
+	}
+	var importance int64
+	db.QueryRow("SELECT importance FROM messages WHERE hash = ?", old.Stamp()).Scan(&importance)
+	if importance != Importance(old) {
+		t.Errorf("expected the importance of the old message to be %d, got %d", Importance(old), importance)
+	}
+	found, err := SearchMessages(SQLiteStore{db}, "#history")
+	if err != nil || len(found) != 1 {
+		t.Errorf("expected the old message to be in the search index, got %v %v", found, err)
+	}
+}
+
+// Test that migrating an up to date database does nothing
+func TestMigrateTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infodump.db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(Migrations) {
+		t.Errorf("expected %d applied migrations, got %d", len(Migrations), applied)
+	}
+}
+
+// Test that a failing migration leaves the database as it was
+func TestMigrationRollback(t *testing.T) {
+	db := newTestDB(t)
+	before, _ := SchemaVersion(db)
+	broken := append(append([]Migration{}, Migrations...), Migration{before + 1, "broken", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("CREATE TABLE half_done(id INTEGER)"); err != nil {
+			return err
+		}
+		return errors.New("something went wrong")
+	}})
+	if err := applyMigrations(db, broken); err == nil {
+		t.Fatal("expected the broken migration to fail")
+	}
+	if after, _ := SchemaVersion(db); after != before {
+		t.Errorf("expected schema version %d after the failed migration, got %d", before, after)
+	}
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'").Scan(&tables)
+	if tables != 0 {
+		t.Error("expected the changes of the failed migration to be rolled back")
+	}
+}
+
+// Test that the busy timeout is added to the options of a database path instead of breaking them
+func TestOpenDatabaseWithOptions(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "infodump.db") + "?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var timeout, foreignKeys int
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 5000 {
+		t.Errorf("expected a busy timeout of 5000, got %d %v", timeout, err)
+	}
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil || foreignKeys != 1 {
+		t.Errorf("expected the foreign keys option to be kept, got %d %v", foreignKeys, err)
+	}
+	if source := databaseSource("infodump.db?_pragma=busy_timeout(100)"); source != "infodump.db?_pragma=busy_timeout(100)" {
+		t.Errorf("expected the busy timeout of the path to be kept, got %s", source)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// PinLeadSetting is the setting with the Lead from which messages are pinned even when they are not saved,
+// 0 only pins the saved messages
+const PinLeadSetting = "pin_lead"
+
+// SaveMessageMenu asks for a message to save, or to stop saving, and updates the pins
+func SaveMessageMenu() {
+	fmt.Println("Enter the hash of the message to save\nTo stop saving it, prefix it with a minus sign: ")
+	prefix := strings.TrimSpace(Readline())
+	m := FindMessage(strings.TrimPrefix(prefix, "-"))
+	if m == nil {
+		return
+	}
+	store := GetStore()
+	if err := SaveMessage(store, m, !strings.HasPrefix(prefix, "-")); err != nil {
+		fmt.Println(err)
+		return
+	}
+	UpdatePins(store)
+}
+
+// ConfigurePinning asks from which Lead messages are pinned without being saved
+func ConfigurePinning() {
+	store := GetStore()
+	fmt.Println("Saved messages are always pinned. At the moment messages are also pinned from a lead of", GetIntSetting(store, PinLeadSetting, 0), "(0 is never)")
+	fmt.Println("From which lead should messages be pinned? ")
+	var lead int
+	fmt.Scanln(&lead)
+	if err := store.SetSetting(PinLeadSetting, strconv.Itoa(lead)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	UpdatePins(store)
+}
+
+// UpdatePins runs SyncPins on the IPFS gateway and tells what it did
+func UpdatePins(store Store) {
+	pinned, unpinned, err := SyncPins(Network, store)
+	if err != nil {
+		fmt.Println("Error updating the pins:", err)
+	}
+	fmt.Println("Pinned", pinned, "and unpinned", unpinned, "messages")
+}
+
+// SaveMessage marks a message as saved, or not saved anymore, adding it to the store if it isn't there yet
+// Saved messages are never trimmed from the store, and SyncPins keeps them pinned
+func SaveMessage(store Store, m *message.Message, saved bool) error {
+	single := &message.Messages{}
+	single.Add(m)
+	if _, err := store.Save(single, SourceLocal); err != nil {
+		return err
+	}
+	return store.SetSaved(m.Stamp(), saved)
+}
+
+// SyncPins makes the pins on the node match the store: the saved messages, and the messages with
+// a Lead of at least the PinLeadSetting, are pinned, and the pins of all other messages are removed,
+// including those of the messages that are no longer in the store
+// The store remembers which CID every message is pinned under, see Store.Pins
+// A pin that can't be removed stays in the store, so it is tried again the next time
+// It returns how many messages were pinned and unpinned
+func SyncPins(t transport.Transport, store Store) (pinned, unpinned int, err error) {
+	lead := GetIntSetting(store, PinLeadSetting, 0)
+	msgs, err := store.Load()
+	if err != nil {
+		return 0, 0, err
+	}
+	saved, err := store.Saved()
+	if err != nil {
+		return 0, 0, err
+	}
+	want := make(map[string]*message.Message)
+	msgs.Each(func(m *message.Message) {
+		if saved[m.Stamp()] || (lead > 0 && m.Lead() >= lead) {
+			want[m.Stamp()] = m
+		}
+	})
+
+	current, err := store.Pins()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for hash, m := range want {
+		if _, ok := current[hash]; ok {
+			continue
+		}
+		cid, err := m.AddToIPFS(t)
+		if err != nil {
+			return pinned, unpinned, err
+		}
+		if err := t.Pin(cid); err != nil {
+			return pinned, unpinned, err
+		}
+		if err := store.SetPin(hash, cid); err != nil {
+			return pinned, unpinned, err
+		}
+		pinned++
+	}
+	var failed int
+	var unpinErr error
+	for hash, cid := range current {
+		if want[hash] != nil {
+			continue
+		}
+		// A pin that is already gone on the node doesn't need to be kept track of either
+		if err := t.Unpin(cid); err != nil && !notPinned(err) {
+			fmt.Println("Error unpinning", cid+":", err)
+			failed++
+			unpinErr = err
+			continue
+		}
+		if err := store.RemovePin(hash); err != nil {
+			return pinned, unpinned, err
+		}
+		unpinned++
+	}
+	if failed > 0 {
+		return pinned, unpinned, fmt.Errorf("%d pins could not be removed: %w", failed, unpinErr)
+	}
+	return pinned, unpinned, nil
+}
+
+// notPinned checks if the error of Unpin says the CID was not pinned in the first place,
+// the IPFS daemon says "not pinned or pinned indirectly"
+func notPinned(err error) bool {
+	return strings.Contains(err.Error(), "not pinned")
+}
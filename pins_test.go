@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// Test that saved and important messages are pinned, that saved messages survive a trim,
+// and that the trimmed messages are unpinned, with both stores
+func TestSyncPins(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) {
+		db := newTestDB(t)
+		testSyncPins(t, SQLiteStore{db})
+	})
+	t.Run("Memory", func(t *testing.T) {
+		testSyncPins(t, &MemoryStore{})
+	})
+}
+
+func testSyncPins(t *testing.T, store Store) {
+	network := transport.NewNetwork()
+	node := network.Node("a")
+	weak, _ := message.New("weak but saved", 0, time.Now().Unix(), time.Minute)
+	strong, _ := message.New("strong", 16, time.Now().Unix(), time.Minute)
+	store.Save(messagesOf(strong), SourceLocal)
+	if err := SaveMessage(store, weak, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned, unpinned, err := SyncPins(node, store); err != nil || pinned != 1 || unpinned != 0 {
+		t.Fatalf("expected only the saved message to be pinned, got %d pinned, %d unpinned, %v", pinned, unpinned, err)
+	}
+	store.SetSetting(PinLeadSetting, "16")
+	if pinned, _, err := SyncPins(node, store); err != nil || pinned != 1 {
+		t.Fatalf("expected the strong message to be pinned too, got %d %v", pinned, err)
+	}
+	pins, _ := store.Pins()
+	for _, m := range []*message.Message{weak, strong} {
+		if !network.Pinned("a", pins[m.Stamp()]) {
+			t.Errorf("expected %q to be pinned on the node", m.Message)
+		}
+	}
+
+	// Only the saved message is kept
+	store.Trim(0)
+	if got, _ := store.Load(); got.Len() != 1 || got.Get(weak.Stamp()) == nil {
+		t.Errorf("expected only the saved message to be left, got %v", stamps(got))
+	}
+	if _, unpinned, err := SyncPins(node, store); err != nil || unpinned != 1 {
+		t.Fatalf("expected the trimmed message to be unpinned, got %d %v", unpinned, err)
+	}
+	if network.Pinned("a", pins[strong.Stamp()]) || !network.Pinned("a", pins[weak.Stamp()]) {
+		t.Error("expected only the saved message to stay pinned on the node")
+	}
+
+	if err := store.SetSaved(strong.Stamp(), true); err == nil {
+		t.Error("expected an error for a message that is not in the store")
+	}
+}
+
+// failingUnpin is a transport of which Unpin fails, like an IPFS daemon that can't be reached
+type failingUnpin struct {
+	*transport.Memory
+}
+
+func (failingUnpin) Unpin(cid string) error {
+	return errors.New("connection refused")
+}
+
+// Test that a pin that can't be removed is kept track of, so it is tried again,
+// and that a pin that is already gone on the node is forgotten
+func TestSyncPinsUnpinFails(t *testing.T) {
+	network := transport.NewNetwork()
+	node := network.Node("a")
+	store := &MemoryStore{}
+	m, _ := message.New("saved for a while", 0, time.Now().Unix(), time.Minute)
+	if err := SaveMessage(store, m, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SyncPins(node, store); err != nil {
+		t.Fatal(err)
+	}
+	pins, _ := store.Pins()
+	cid := pins[m.Stamp()]
+
+	store.SetSaved(m.Stamp(), false)
+	if _, unpinned, err := SyncPins(failingUnpin{node}, store); err == nil || unpinned != 0 {
+		t.Errorf("expected unpinning to fail, got %d unpinned, %v", unpinned, err)
+	}
+	if pins, _ := store.Pins(); pins[m.Stamp()] != cid || !network.Pinned("a", cid) {
+		t.Fatal("expected the pin to be kept when unpinning failed")
+	}
+
+	node.Unpin(cid)
+	if _, unpinned, err := SyncPins(node, store); err != nil || unpinned != 1 {
+		t.Errorf("expected the pin that is gone already to be forgotten, got %d unpinned, %v", unpinned, err)
+	}
+	if pins, _ := store.Pins(); len(pins) != 0 {
+		t.Errorf("expected no pins to be left, got %v", pins)
+	}
+}
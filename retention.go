@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// RetentionPeriodSetting is how long a message without proof of work is kept, like 168h, 0 keeps all messages
+const RetentionPeriodSetting = "retention_period"
+
+// RetentionIntervalSetting is how often the expired messages are removed, like 10m
+const RetentionIntervalSetting = "retention_interval"
+
+// Retention decides when messages expire
+// A message without proof of work expires Period after it was written, a message with proof of work
+// Period after it stopped being more important than new messages without proof of work, see Message.SortNum
+// So the more work went into a message, the longer it is kept
+type Retention struct {
+	Period   time.Duration
+	Interval time.Duration
+}
+
+// DefaultRetention keeps messages without proof of work for a week and looks for expired messages every 10 minutes
+var DefaultRetention = Retention{Period: 7 * 24 * time.Hour, Interval: 10 * time.Minute}
+
+// lastExpiry is when ExpireIfDue last removed the expired messages
+var lastExpiry time.Time
+
+// Expiry returns the time from which the message is expired
+func (r Retention) Expiry(m *message.Message) time.Time {
+	return message.DefaultRanker.Expiry(m, 1).Add(r.Period)
+}
+
+// Expired checks if the message is expired at the given time, nothing expires if the Period is 0
+func (r Retention) Expired(m *message.Message, now time.Time) bool {
+	return r.Period > 0 && now.After(r.Expiry(m))
+}
+
+// Unexpired returns the messages that are not expired at the given time
+func (r Retention) Unexpired(msgs *message.Messages, now time.Time) *message.Messages {
+	fresh := &message.Messages{}
+	msgs.Each(func(m *message.Message) {
+		if !r.Expired(m, now) {
+			fresh.Add(m)
+		}
+	})
+	return fresh
+}
+
+// LoadRetention reads the retention settings from the store, using DefaultRetention for what is not set
+func LoadRetention(store Store) Retention {
+	r := DefaultRetention
+	if period, err := time.ParseDuration(GetSetting(store, RetentionPeriodSetting, r.Period.String())); err == nil {
+		r.Period = period
+	}
+	if interval, err := time.ParseDuration(GetSetting(store, RetentionIntervalSetting, r.Interval.String())); err == nil && interval > 0 {
+		r.Interval = interval
+	}
+	return r
+}
+
+// SaveRetention stores the retention settings in the store
+func SaveRetention(store Store, r Retention) error {
+	if err := store.SetSetting(RetentionPeriodSetting, r.Period.String()); err != nil {
+		return err
+	}
+	return store.SetSetting(RetentionIntervalSetting, r.Interval.String())
+}
+
+// ConfigureRetention asks how long messages are kept and how often the expired ones are removed
+func ConfigureRetention() {
+	store := GetStore()
+	r := LoadRetention(store)
+	fmt.Println("Messages without proof of work are kept for", r.Period, "(0 keeps all messages), messages with proof of work longer")
+	fmt.Println("How long should messages without proof of work be kept? (e.g. 168h, empty keeps the current setting) ")
+	if answer := Readline(); answer != "" {
+		period, err := time.ParseDuration(answer)
+		if err != nil || period < 0 {
+			fmt.Println("Invalid duration:", answer)
+			return
+		}
+		r.Period = period
+	}
+	fmt.Println("Expired messages are removed every", r.Interval)
+	fmt.Println("How often should expired messages be removed? (e.g. 10m, empty keeps the current setting) ")
+	if answer := Readline(); answer != "" {
+		interval, err := time.ParseDuration(answer)
+		if err != nil || interval <= 0 {
+			fmt.Println("Invalid duration:", answer)
+			return
+		}
+		r.Interval = interval
+	}
+	if err := SaveRetention(store, r); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// ExpireOldMessages removes the expired messages from LocalMessages and the database right away
+func ExpireOldMessages() {
+	store := GetStore()
+	local, stored, err := ExpireMessages(store, &LocalMessages, LoadRetention(store), time.Now())
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("Removed", local, "expired messages from memory and", stored, "from the database")
+	lastExpiry = time.Now()
+}
+
+// ExpireIfDue removes the expired messages from LocalMessages and the database, if the database is set,
+// when the retention interval has passed since the last time
+func ExpireIfDue() {
+	// Without a database only the messages in memory expire
+	var store Store
+	r := DefaultRetention
+	if DB != nil {
+		store = SQLiteStore{DB}
+		r = LoadRetention(store)
+	}
+	if time.Since(lastExpiry) < r.Interval {
+		return
+	}
+	lastExpiry = time.Now()
+	local, stored, err := ExpireMessages(store, &LocalMessages, r, time.Now())
+	if err != nil {
+		fmt.Println("Error removing expired messages:", err)
+	}
+	if local > 0 || stored > 0 {
+		fmt.Println("Removed", local, "expired messages from memory and", stored, "from the database")
+	}
+}
+
+// ExpireMessages removes the messages that are expired at the given time from msgs and from the store,
+// except the saved messages, store can be nil to only remove them from msgs
+// It returns how many messages were removed from msgs and from the store
+func ExpireMessages(store Store, msgs *message.Messages, r Retention, now time.Time) (int, int, error) {
+	if r.Period <= 0 {
+		return 0, 0, nil
+	}
+	saved := make(map[string]bool)
+	if store != nil {
+		stamps, err := store.Saved()
+		if err != nil {
+			return 0, 0, err
+		}
+		saved = stamps
+	}
+
+	// Each holds the lock of msgs, so the messages are removed after it
+	var gone []string
+	msgs.Each(func(m *message.Message) {
+		if !saved[m.Stamp()] && r.Expired(m, now) {
+			gone = append(gone, m.Stamp())
+		}
+	})
+	for _, stamp := range gone {
+		msgs.Remove(stamp)
+	}
+	if store == nil {
+		return len(gone), 0, nil
+	}
+	stored, err := store.Expire(r, now)
+	return len(gone), stored, err
+}
+
+// updateImportance gives the messages from the future whose time has come at now their importance,
+// they were stored with an importance of 0, see Importance
+func updateImportance(tx *sql.Tx, now time.Time) error {
+	rows, err := tx.Query("SELECT "+messageColumns+" FROM messages WHERE importance = 0 AND timestamp <= ?", now.Unix())
+	if err != nil {
+		return err
+	}
+	importance := make(map[string]int64)
+	for rows.Next() {
+		hash, m, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		importance[hash] = message.DefaultRanker.Expiry(m, 1).Unix()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for hash, value := range importance {
+		if _, err := tx.Exec("UPDATE messages SET importance = ? WHERE hash = ?", value, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
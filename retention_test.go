@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Test that expired messages are removed from memory and the database, but saved and strong messages are kept
+func TestExpireMessages(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	week := 7 * 24 * time.Hour
+	old := weakMessage("old", now.Add(-week-time.Hour))
+	saved := weakMessage("old but saved", now.Add(-week-time.Hour))
+	// A lead of 16 keeps the message ahead of messages without proof of work for 8 hours, and a week after that
+	strong, _ := message.New("old but strong", 16, now.Add(-week-4*time.Hour).Unix(), time.Minute)
+	fresh, _ := message.New("fresh", 0, now.Unix(), time.Minute)
+	all := messagesOf(old, saved, strong, fresh)
+	SaveMessages(SQLiteStore{db}, all, SourceLocal)
+	if err := (SQLiteStore{db}).SetSaved(saved.Stamp(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	r := Retention{Period: week, Interval: time.Minute}
+	local, stored, err := ExpireMessages(SQLiteStore{db}, all, r, now)
+	if err != nil || local != 1 || stored != 1 {
+		t.Fatalf("expected 1 message to be removed from memory and the database, got %d and %d, %v", local, stored, err)
+	}
+	for _, msgs := range []*message.Messages{all, GetMessagesFromDatabase(db)} {
+		if msgs.Get(old.Stamp()) != nil || msgs.Len() != 3 {
+			t.Errorf("expected only the old message to be removed, got %v", stamps(msgs))
+		}
+	}
+
+	if local, stored, _ := ExpireMessages(SQLiteStore{db}, all, Retention{}, now.Add(100*week)); local != 0 || stored != 0 {
+		t.Error("expected nothing to expire without a retention period")
+	}
+}
+
+// weakMessage returns a message without proof of work whose hash doesn't start with a zero by chance either,
+// so it has expired exactly one retention period after it was written
+func weakMessage(text string, timestamp time.Time) *message.Message {
+	m := &message.Message{Version: message.CurrentVersion, Message: text, Timestamp: timestamp.Unix()}
+	for m.Lead() != 0 {
+		m.Nonce++
+	}
+	return m
+}
+
+// Test that messages from the future are trimmed first, like in memory, don't expire, and get their importance once their time has come
+func TestFutureMessages(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	week := 7 * 24 * time.Hour
+	weak, _ := message.New("weak", 0, now.Unix(), time.Minute)
+	early, _ := message.New("from the future", 16, now.Add(time.Hour).Unix(), time.Minute)
+	later, _ := message.New("also from the future", 16, now.Add(2*time.Hour).Unix(), time.Minute)
+	SaveMessages(SQLiteStore{db}, messagesOf(weak, later), SourceLocal)
+
+	// In memory the message from the future goes first as well, its SortNum is 0
+	if kept := messagesOf(weak, later).MessageList()[0]; kept != weak {
+		t.Fatalf("expected the weak message to be more important in memory")
+	}
+	if removed, err := TrimDatabaseTo(db, 1); err != nil || removed != 1 {
+		t.Fatalf("expected 1 message to be trimmed, removed %d %v", removed, err)
+	}
+	if got := stamps(GetMessagesFromDatabase(db)); len(got) != 1 || got[0] != weak.Stamp() {
+		t.Errorf("expected the message from the future to be trimmed, got %v", got)
+	}
+
+	SaveMessages(SQLiteStore{db}, messagesOf(early), SourceLocal)
+
+	if _, stored, err := ExpireMessages(SQLiteStore{db}, &message.Messages{}, Retention{Period: week}, now); err != nil || stored != 0 {
+		t.Errorf("expected the message from the future not to expire, removed %d %v", stored, err)
+	}
+	// Once its time has come, the message gets the importance of its proof of work
+	if _, _, err := ExpireMessages(SQLiteStore{db}, &message.Messages{}, Retention{Period: week}, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var importance int64
+	db.QueryRow("SELECT importance FROM messages WHERE hash = ?", early.Stamp()).Scan(&importance)
+	if want := message.DefaultRanker.Expiry(early, 1).Unix(); importance != want {
+		t.Errorf("expected the importance of the message to be %d once its time has come, got %d", want, importance)
+	}
+}
+
+// Test that the retention settings are stored in the database
+func TestRetentionSettings(t *testing.T) {
+	db := newTestDB(t)
+	if r := LoadRetention(SQLiteStore{db}); r != DefaultRetention {
+		t.Errorf("expected the default retention, got %+v", r)
+	}
+	want := Retention{Period: 48 * time.Hour, Interval: time.Minute}
+	if err := SaveRetention(SQLiteStore{db}, want); err != nil {
+		t.Fatal(err)
+	}
+	if r := LoadRetention(SQLiteStore{db}); r != want {
+		t.Errorf("expected %+v, got %+v", want, r)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// SearchImportanceWeight is how much the importance of a message counts in the search ranking,
+// between 0 (only the full text rank counts) and 1 (only the importance counts)
+var SearchImportanceWeight = 0.3
+
+// SearchCandidates is the number of best full text matches that are ranked by SearchMessages
+var SearchCandidates = 200
+
+// SearchResult is a message that matches a search, with how relevant it is, the higher the better
+type SearchResult struct {
+	Message   *message.Message
+	Relevance float64
+}
+
+// searchTerm is a part of a search query: a word, or a phrase of words that have to follow each other
+// A prefix term matches every word that starts with it
+type searchTerm struct {
+	text   string
+	prefix bool
+}
+
+// parseSearchTerms splits a search query as typed by the user into its terms
+// Words between double quotes are searched for as a phrase, a word ending in * matches every word starting with it,
+// and #tags and @mentions match the tag exactly. All terms of the query have to match
+func parseSearchTerms(query string) []searchTerm {
+	var terms []searchTerm
+	for i, part := range strings.Split(query, `"`) {
+		// Every odd part was between quotes
+		if i%2 == 1 {
+			if words := strings.Fields(part); len(words) > 0 {
+				terms = append(terms, searchTerm{text: strings.Join(words, " ")})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if strings.HasSuffix(word, "*") {
+				if word = strings.TrimRight(word, "*"); word != "" {
+					terms = append(terms, searchTerm{text: word, prefix: true})
+				}
+				continue
+			}
+			terms = append(terms, searchTerm{text: word})
+		}
+	}
+	return terms
+}
+
+// count returns how often the term occurs in the words, see searchWords
+func (term searchTerm) count(words []string) int {
+	phrase := searchWords(term.text)
+	n := 0
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		found := true
+		for j, word := range phrase {
+			last := j == len(phrase)-1
+			if words[i+j] != word && !(term.prefix && last && strings.HasPrefix(words[i+j], word)) {
+				found = false
+				break
+			}
+		}
+		if found {
+			n++
+		}
+	}
+	return n
+}
+
+// searchWords splits a text into lowercase words the way the full text index messages_fts does,
+// # and @ are part of a word, so a tag only matches the tag
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '#' && r != '@'
+	})
+}
+
+// ParseSearchQuery turns a search query as typed by the user into an FTS5 query, see parseSearchTerms
+func ParseSearchQuery(query string) string {
+	var parts []string
+	for _, term := range parseSearchTerms(query) {
+		part := quoteSearchTerm(term.text)
+		if term.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteSearchTerm quotes a term for FTS5 so that it is never read as an operator
+func quoteSearchTerm(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// SearchMessages searches the store for messages matching the query, see parseSearchTerms
+// The SearchCandidates best matches are ranked by their relevance combined with their importance (SortNum),
+// weighted by SearchImportanceWeight
+func SearchMessages(store Store, query string) ([]*message.Message, error) {
+	if len(parseSearchTerms(query)) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+	results, err := store.Search(query, SearchCandidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	// Scale both the relevance and the importance to 0..1 among the results and combine them
+	maxRelevance := results[0].Relevance
+	minSort, maxSort := results[0].Message.SortNum(), results[0].Message.SortNum()
+	for _, r := range results {
+		if r.Relevance > maxRelevance {
+			maxRelevance = r.Relevance
+		}
+		if s := r.Message.SortNum(); s < minSort {
+			minSort = s
+		} else if s > maxSort {
+			maxSort = s
+		}
+	}
+	score := func(r SearchResult) float64 {
+		var relevance, importance float64
+		if maxRelevance > 0 {
+			relevance = r.Relevance / maxRelevance
+		}
+		if maxSort > minSort {
+			importance = float64(r.Message.SortNum()-minSort) / float64(maxSort-minSort)
+		}
+		return (1-SearchImportanceWeight)*relevance + SearchImportanceWeight*importance
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return score(results[i]) > score(results[j])
+	})
+	msgs := make([]*message.Message, len(results))
+	for i, r := range results {
+		msgs[i] = r.Message
+	}
+	return msgs, nil
+}
+
+// prefixColumns prefixes every column in a comma separated list with the table name
+func prefixColumns(table, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, col := range cols {
+		cols[i] = table + "." + col
+	}
+	return strings.Join(cols, ", ")
+}
+
+// SearchMenu asks the user for a search query and shows the matching messages from the database, 10 at a time
+func SearchMenu() {
+	db := GetDatabase()
+	if db == nil {
+		return
+	}
+	fmt.Println(`Enter your search: words, "a phrase", prefix* or #tag`)
+	msgs, err := SearchMessages(SQLiteStore{db}, Readline())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Found", len(msgs), "messages")
+	for i, m := range msgs {
+		fmt.Println(m)
+		if i%10 == 9 {
+			fmt.Println("Press enter to continue... Type anything to stop")
+			contp := Readline()
+			if contp != "" {
+				return
+			}
+		}
+	}
+}
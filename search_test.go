@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Test that user queries are turned into safe FTS5 queries
+func TestParseSearchQuery(t *testing.T) {
+	for query, expected := range map[string]string{
+		`hello world`:         `"hello" "world"`,
+		`"hello world" again`: `"hello world" "again"`,
+		`hel*`:                `"hel"*`,
+		`#infodump @bob`:      `"#infodump" "@bob"`,
+		`NOT AND OR`:          `"NOT" "AND" "OR"`,
+		`  `:                  ``,
+	} {
+		if got := ParseSearchQuery(query); got != expected {
+			t.Errorf("ParseSearchQuery(%q) = %q, expected %q", query, got, expected)
+		}
+	}
+}
+
+// Test searching for words, phrases, prefixes and tags, with both stores
+func TestSearchMessages(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) {
+		db := newTestDB(t)
+		testSearchMessages(t, SQLiteStore{db})
+		// The index follows changes of the text, and only those
+		if _, err := db.Exec("UPDATE messages SET message = 'a slow reply' WHERE message LIKE 'a quick%'"); err != nil {
+			t.Fatal(err)
+		}
+		if msgs, err := SearchMessages(SQLiteStore{db}, "slow"); err != nil || len(msgs) != 1 {
+			t.Errorf("expected the changed text to be found, got %d results, %v", len(msgs), err)
+		}
+	})
+	t.Run("Memory", func(t *testing.T) {
+		testSearchMessages(t, &MemoryStore{})
+	})
+}
+
+func testSearchMessages(t *testing.T, store Store) {
+	now := time.Now().Unix()
+	for _, text := range []string{
+		"the quick brown fox",
+		"a quick reply about #golang",
+		"brown bread is quick to make",
+	} {
+		m := &message.Message{Version: message.CurrentVersion, Message: text, Timestamp: now}
+		if _, err := store.Save(messagesOf(m), SourceLocal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for query, expected := range map[string]int{
+		`quick`:         3,
+		`"quick brown"`: 1,
+		`bro*`:          2,
+		`#golang`:       1,
+		`golang`:        0,
+		`quick -`:       3,
+	} {
+		msgs, err := SearchMessages(store, query)
+		if err != nil {
+			t.Errorf("searching %q: %v", query, err)
+			continue
+		}
+		if len(msgs) != expected {
+			t.Errorf("searching %q: expected %d results, got %d", query, expected, len(msgs))
+		}
+	}
+	if _, err := SearchMessages(store, "  "); err == nil {
+		t.Error("expected an error for an empty search")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// GetSetting returns the value of a setting in the store, or def if it is not set or can't be read
+func GetSetting(store Store, key, def string) string {
+	value, err := store.Setting(key, def)
+	if err != nil {
+		fmt.Println(err)
+		return def
+	}
+	return value
+}
+
+// GetIntSetting returns the value of a setting that is a number, or def if it is not set or not a number
+func GetIntSetting(store Store, key string, def int) int {
+	value, err := strconv.Atoi(GetSetting(store, key, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return value
+}
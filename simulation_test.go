@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// simulation runs several Infodump nodes in one process on an in-memory network
+type simulation struct {
+	t       *testing.T
+	network *transport.Network
+	nodes   map[string]*simNode
+}
+
+// simNode is a single Infodump node with its own transport, store and messages,
+// it handles what it receives the same way the daemon does
+type simNode struct {
+	ID        string
+	Transport *transport.Memory
+	Store     Store
+	Messages  *message.Messages
+
+	lock      sync.Mutex
+	received  map[string][]string
+	stop      context.CancelFunc
+	listeners *sync.WaitGroup
+}
+
+// newSimulation creates a network with a node for each of the IDs, the nodes are not listening yet
+func newSimulation(t *testing.T, ids ...string) *simulation {
+	sim := &simulation{t: t, network: transport.NewNetwork(), nodes: make(map[string]*simNode)}
+	for _, id := range ids {
+		node := &simNode{
+			ID:        id,
+			Transport: sim.network.Node(id),
+			Store:     &MemoryStore{},
+			Messages:  &message.Messages{},
+			received:  make(map[string][]string),
+		}
+		sim.nodes[id] = node
+		t.Cleanup(node.Stop)
+	}
+	return sim
+}
+
+// Node returns the node with the given ID
+func (sim *simulation) Node(id string) *simNode {
+	node, ok := sim.nodes[id]
+	if !ok {
+		sim.t.Fatalf("no node %s in the simulation", id)
+	}
+	return node
+}
+
+// Start makes the nodes listen to "OLN" and their followed tags, and waits until they are subscribed
+func (sim *simulation) Start(ids ...string) {
+	for _, id := range ids {
+		node := sim.Node(id)
+		topics := FollowedTopics(node.Store)
+		before := make(map[string]int)
+		for _, topic := range topics {
+			before[topic] = sim.network.Subscribers(topic)
+		}
+		node.Start()
+		for _, topic := range topics {
+			topic := topic
+			subscribed := eventually(time.Second, func() bool {
+				return sim.network.Subscribers(topic) > before[topic]
+			})
+			if !subscribed {
+				sim.t.Fatalf("%s didn't subscribe to %s", id, topic)
+			}
+		}
+	}
+}
+
+// Start listens for messages and saves the new ones, until Stop is called
+func (node *simNode) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	node.stop = cancel
+	receive := func(topic string, msgs *message.Messages) *message.Messages {
+		msgs.Each(func(m *message.Message) {
+			node.received[topic] = append(node.received[topic], m.Stamp())
+		})
+		return msgs
+	}
+	node.listeners = ListenForMessages(ctx, node.Transport, node.Store, node.Messages, saveBatches(&node.lock, node.Store, node.Messages, receive, nil))
+}
+
+// Stop stops listening and waits until the listeners are done
+func (node *simNode) Stop() {
+	if node.stop == nil {
+		return
+	}
+	node.stop()
+	node.listeners.Wait()
+	node.stop = nil
+}
+
+// Post creates a message with the given difficulty, saves it and returns it, without publishing it
+func (node *simNode) Post(t *testing.T, text string, difficulty int) *message.Message {
+	m, err := message.New(text, difficulty, time.Now().Unix(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if _, err := SaveNewMessages(node.Store, node.Messages, messagesOf(m), SourceLocal); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Publish publishes all messages of the node
+func (node *simNode) Publish(t *testing.T) {
+	_, err := PublishMessages(node.Transport, node.Store, node.Messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Received returns the stamps the node received on a topic
+func (node *simNode) Received(topic string) []string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return append([]string{}, node.received[topic]...)
+}
+
+// Trim keeps only the num most important messages of the node, in memory and in the store
+func (node *simNode) Trim(num int) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.Messages.Trim(num)
+	node.Store.Trim(num)
+}
+
+// Stored returns the messages in the store of the node
+func (node *simNode) Stored() *message.Messages {
+	stored, err := node.Store.Load()
+	if err != nil {
+		return &message.Messages{}
+	}
+	return stored
+}
+
+// stamps returns the sorted stamps of the messages
+func stamps(msgs *message.Messages) []string {
+	var list []string
+	msgs.Each(func(m *message.Message) {
+		list = append(list, m.Stamp())
+	})
+	sort.Strings(list)
+	return list
+}
+
+// messagesOf puts the messages in a Messages map
+func messagesOf(msgs ...*message.Message) *message.Messages {
+	result := &message.Messages{}
+	for _, m := range msgs {
+		result.Add(m)
+	}
+	return result
+}
+
+// eventually checks the condition until it holds, it returns false if it doesn't within the timeout
+func eventually(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// AssertConverged waits until the nodes have exactly the expected messages, both in memory and in their store
+func (sim *simulation) AssertConverged(timeout time.Duration, expected []*message.Message, ids ...string) {
+	sim.t.Helper()
+	want := stamps(messagesOf(expected...))
+	for _, id := range ids {
+		node := sim.Node(id)
+		var got string
+		converged := eventually(timeout, func() bool {
+			node.lock.Lock()
+			defer node.lock.Unlock()
+			inMemory := stamps(node.Messages)
+			inStore := stamps(node.Stored())
+			got = fmt.Sprint(inMemory, inStore)
+			return strings.Join(inMemory, " ") == strings.Join(want, " ") &&
+				strings.Join(inStore, " ") == strings.Join(want, " ")
+		})
+		if !converged {
+			sim.t.Fatalf("%s didn't converge, expected %v, got %s", id, want, got)
+		}
+	}
+}
+
+// Test that messages posted on different nodes reach all of them
+func TestSimulationConvergence(t *testing.T) {
+	sim := newSimulation(t, "a", "b", "c", "d")
+	sim.Start("a", "b", "c", "d")
+	var posted []*message.Message
+	for _, id := range []string{"a", "b", "c", "d"} {
+		posted = append(posted, sim.Node(id).Post(t, "hello from "+id, 8))
+		sim.Node(id).Publish(t)
+	}
+	sim.AssertConverged(5*time.Second, posted, "a", "b", "c", "d")
+}
+
+// Test that a partition keeps messages on its own side until it heals and the nodes publish again
+func TestSimulationPartition(t *testing.T) {
+	sim := newSimulation(t, "a", "b", "c", "d")
+	sim.Start("a", "b", "c", "d")
+	sim.network.Partition([]string{"a", "b"}, []string{"c", "d"})
+	left := sim.Node("a").Post(t, "left side", 8)
+	right := sim.Node("c").Post(t, "right side", 8)
+	sim.Node("a").Publish(t)
+	sim.Node("c").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{left}, "a", "b")
+	sim.AssertConverged(5*time.Second, []*message.Message{right}, "c", "d")
+
+	sim.network.Heal()
+	sim.Node("b").Publish(t)
+	sim.Node("d").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{left, right}, "a", "b", "c", "d")
+}
+
+// Test that messages arrive after the latency of the network, not before
+func TestSimulationLatency(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	sim.Start("a", "b")
+	sim.network.SetLatency(200 * time.Millisecond)
+	m := sim.Node("a").Post(t, "slow news", 8)
+	sim.Node("a").Publish(t)
+	if got := sim.Node("b").Received("OLN"); len(got) != 0 {
+		t.Errorf("expected nothing before the latency passed, got %v", got)
+	}
+	sim.AssertConverged(5*time.Second, []*message.Message{m}, "a", "b")
+}
+
+// Test that a stopped listener doesn't receive anything, and that the messages are saved once
+func TestSimulationListener(t *testing.T) {
+	sim := newSimulation(t, "a", "b", "c")
+	sim.Start("a", "b", "c")
+	first := sim.Node("a").Post(t, "first", 8)
+	sim.Node("a").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{first}, "a", "b", "c")
+
+	sim.Node("c").Stop()
+	second := sim.Node("a").Post(t, "second", 8)
+	sim.Node("a").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{first, second}, "a", "b")
+	sim.AssertConverged(time.Second, []*message.Message{first}, "c")
+	// Only the new message is published the second time
+	if got := len(sim.Node("b").Received("OLN")); got != 2 {
+		t.Errorf("expected b to receive 2 messages on OLN, got %d", got)
+	}
+
+	// With nothing new, the last batch is announced again, and c follows the chain back to what it missed
+	sim.Start("c")
+	sim.Node("a").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{first, second}, "a", "b", "c")
+}
+
+// Test that the received batches are recorded, and not read again after a restart when they are announced again
+func TestSimulationHistory(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	sim.Start("a", "b")
+	a, b := sim.Node("a"), sim.Node("b")
+	posted := a.Post(t, "remember me", 8)
+	a.Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{posted}, "b")
+
+	b.Stop()
+	sim.Start("b")
+	a.Publish(t)
+	recorded := eventually(5*time.Second, func() bool {
+		batches, _ := b.Store.ReceivedBatches(0)
+		return len(batches) == 1 && batches[0].Times == 2
+	})
+	if !recorded {
+		batches, _ := b.Store.ReceivedBatches(0)
+		t.Fatalf("expected the batch to be recorded twice, got %v", batches)
+	}
+	batches, _ := b.Store.ReceivedBatches(0)
+	if got := batches[0]; got.Topic != "OLN" || got.Peer != "a" || got.Count != 1 {
+		t.Errorf("expected a batch of 1 message from a on OLN, got %v", got)
+	}
+	if got := b.Received("OLN"); len(got) != 1 {
+		t.Errorf("expected b to read the batch only once, got %v", got)
+	}
+}
+
+// Test that a batch whose messages could not be handled is not recorded, so it is read again when it is announced again
+func TestSimulationHandleError(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	a, b := sim.Node("a"), sim.Node("b")
+	a.Post(t, "try again", 8)
+	a.Publish(t)
+	cid, err := a.Store.LastPublishedBatch("OLN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := &batchHistory{known: b.Messages, store: b.Store}
+	failing := func(topic string, msgs *message.Messages) error { return fmt.Errorf("disk full") }
+	if next := readBatches(b.Transport, "OLN", "a", cid, history, failing); next != cid {
+		t.Errorf("expected to stop at the batch that failed, got %q", next)
+	}
+	if batches, _ := b.Store.ReceivedBatches(0); len(batches) != 0 {
+		t.Errorf("expected the batch not to be recorded, got %v", batches)
+	}
+	handled := 0
+	handle := func(topic string, msgs *message.Messages) error {
+		handled += msgs.Len()
+		return nil
+	}
+	if next := readBatches(b.Transport, "OLN", "a", cid, history, handle); next != "" || handled != 1 {
+		t.Errorf("expected the batch to be read again, handled %d messages and stopped at %q", handled, next)
+	}
+	if batches, _ := b.Store.ReceivedBatches(0); len(batches) != 1 {
+		t.Errorf("expected the batch to be recorded once it was handled, got %v", batches)
+	}
+}
+
+// Test that only the announced batch is recorded under the peer, and not the batches before it in the chain
+func TestSimulationHistoryChain(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	a, b := sim.Node("a"), sim.Node("b")
+	a.Post(t, "older", 8)
+	a.Publish(t)
+	older, err := a.Store.LastPublishedBatch("OLN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Post(t, "newer", 8)
+	a.Publish(t)
+	newer, err := a.Store.LastPublishedBatch("OLN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := &batchHistory{known: b.Messages, store: b.Store}
+	handle := func(topic string, msgs *message.Messages) error { return nil }
+	if next := readBatches(b.Transport, "OLN", "c", newer, history, handle); next != "" {
+		t.Errorf("expected to read the whole chain, stopped at %q", next)
+	}
+	if _, ok := history.seen("OLN", older); !ok {
+		t.Error("expected the older batch to be remembered")
+	}
+	batches, _ := b.Store.ReceivedBatches(0)
+	if len(batches) != 1 || batches[0].CID != newer || batches[0].Peer != "c" {
+		t.Errorf("expected only the announced batch to be recorded from c, got %v", batches)
+	}
+}
+
+func TestSimulationDeltaSync(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	a := sim.Node("a")
+	var posted []*message.Message
+	var cids []string
+	for i := 0; i < 3; i++ {
+		posted = append(posted, a.Post(t, fmt.Sprintf("message %d", i), 8))
+		cid, err := PublishMessages(a.Transport, a.Store, a.Messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, cid)
+	}
+	for i, cid := range cids {
+		batch, err := message.BatchFromIPFS(a.Transport, cid, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stamps(batch.Messages); len(got) != 1 || got[0] != posted[i].Stamp() {
+			t.Errorf("expected batch %d to only have its new message, got %v", i, got)
+		}
+		if i > 0 && batch.Previous != cids[i-1] {
+			t.Errorf("expected batch %d to link to %s, got %q", i, cids[i-1], batch.Previous)
+		}
+	}
+
+	// b joins late and reads the whole chain from the last batch
+	sim.Start("b")
+	if cid, err := PublishMessages(a.Transport, a.Store, a.Messages); err != nil || cid != cids[2] {
+		t.Fatalf("expected the last batch %s to be announced again, got %s %v", cids[2], cid, err)
+	}
+	sim.AssertConverged(5*time.Second, posted, "b")
+}
+
+// Test that messages are published on the topics of their tags, and only reach the followers of those tags there
+func TestSimulationPublishByTag(t *testing.T) {
+	sim := newSimulation(t, "a", "b", "c")
+	if err := sim.Node("b").Store.FollowTag("#golang"); err != nil {
+		t.Fatal(err)
+	}
+	sim.Start("a", "b", "c")
+	tagged := sim.Node("a").Post(t, "generics are here #golang", 8)
+	untagged := sim.Node("a").Post(t, "nothing to see", 8)
+	sim.Node("a").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{tagged, untagged}, "a", "b", "c")
+
+	eventually(time.Second, func() bool { return len(sim.Node("b").Received("oln-#golang")) > 0 })
+	if got := sim.Node("b").Received("oln-#golang"); len(got) != 1 || got[0] != tagged.Stamp() {
+		t.Errorf("expected b to receive only the tagged message on its tag, got %v", got)
+	}
+	if got := sim.Node("c").Received("oln-#golang"); len(got) != 0 {
+		t.Errorf("expected c not to receive anything on a tag it doesn't follow, got %v", got)
+	}
+}
+
+// Test that trimming keeps the most important messages, and that only those are passed on afterwards
+func TestSimulationTrim(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	a := sim.Node("a")
+	weak := a.Post(t, "weak", 0)
+	strong := a.Post(t, "strong", 16)
+	a.Trim(1)
+	if got := stamps(a.Stored()); len(got) != 1 || got[0] != strong.Stamp() {
+		t.Fatalf("expected only the strong message after trimming, got %v (weak is %s)", got, weak.Stamp())
+	}
+
+	sim.Start("b")
+	a.Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{strong}, "a", "b")
+}
+
+// Test that messages with a place reach the nodes that follow an area around it, and not the ones far away
+func TestSimulationFollowArea(t *testing.T) {
+	sim := newSimulation(t, "a", "b", "c")
+	if tag, err := FollowArea(sim.Node("b").Store, "52.37,4.89", 10); err != nil || tag != "~geo:u173" {
+		t.Fatalf("expected b to follow ~geo:u173, got %s %v", tag, err)
+	}
+	if _, err := FollowArea(sim.Node("c").Store, "48.8566,2.3522", 10); err != nil {
+		t.Fatal(err)
+	}
+	sim.Start("a", "b", "c")
+	amsterdam := sim.Node("a").Post(t, "coffee at ~52.3676,4.9041", 8)
+	sim.Node("a").Publish(t)
+	sim.AssertConverged(5*time.Second, []*message.Message{amsterdam}, "a", "b", "c")
+
+	eventually(time.Second, func() bool { return len(sim.Node("b").Received("oln-geo-u173")) > 0 })
+	if got := sim.Node("b").Received("oln-geo-u173"); len(got) != 1 || got[0] != amsterdam.Stamp() {
+		t.Errorf("expected b to receive the message in its area, got %v", got)
+	}
+	for _, topic := range FollowedTopics(sim.Node("c").Store) {
+		if topic != "OLN" && len(sim.Node("c").Received(topic)) != 0 {
+			t.Errorf("expected c not to receive the message on %s", topic)
+		}
+	}
+}
+
+func TestSimulationFeeds(t *testing.T) {
+	sim := newSimulation(t, "a", "b")
+	a, b := sim.Node("a"), sim.Node("b")
+	// b is not listening, so it misses everything a announces on PubSub
+	first := a.Post(t, "first", 8)
+	a.Publish(t)
+	if _, err := PublishFeed(a.Transport, a.Store); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store.FollowFeed("/ipns/a"); err != nil {
+		t.Fatal(err)
+	}
+	pulled := PullFeeds(b.Transport, b.Store, b.Messages)
+	if got := stamps(pulled); len(got) != 1 || got[0] != first.Stamp() {
+		t.Fatalf("expected to pull the first message, got %v", got)
+	}
+	SaveNewMessages(b.Store, b.Messages, pulled, SourceFeeds)
+
+	// Only the batches since the last pull are read
+	second := a.Post(t, "second", 8)
+	a.Publish(t)
+	third := a.Post(t, "third", 8)
+	a.Publish(t)
+	if _, err := PublishFeed(a.Transport, a.Store); err != nil {
+		t.Fatal(err)
+	}
+	pulled = PullFeeds(b.Transport, b.Store, b.Messages)
+	if got := pulled.Len(); got != 2 {
+		t.Errorf("expected to pull 2 new messages, got %d", got)
+	}
+	SaveNewMessages(b.Store, b.Messages, pulled, SourceFeeds)
+	sim.AssertConverged(time.Second, []*message.Message{first, second, third}, "a", "b")
+	if got := PullFeeds(b.Transport, b.Store, b.Messages).Len(); got != 0 {
+		t.Errorf("expected nothing new from an unchanged feed, got %d messages", got)
+	}
+
+	// A pull stops after MaxHistoryDepth batches, the next one continues where it stopped
+	var later []*message.Message
+	for i := 0; i < MaxHistoryDepth+2; i++ {
+		later = append(later, a.Post(t, fmt.Sprint("later ", i), 8))
+		a.Publish(t)
+	}
+	if _, err := PublishFeed(a.Transport, a.Store); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := SaveNewMessages(b.Store, b.Messages, PullFeeds(b.Transport, b.Store, b.Messages), SourceFeeds); err != nil || got != MaxHistoryDepth {
+		t.Errorf("expected to pull %d new messages, got %d %v", MaxHistoryDepth, got, err)
+	}
+	if got, err := SaveNewMessages(b.Store, b.Messages, PullFeeds(b.Transport, b.Store, b.Messages), SourceFeeds); err != nil || got != 2 {
+		t.Errorf("expected the next pull to get the 2 messages that were left, got %d %v", got, err)
+	}
+	sim.AssertConverged(time.Second, append([]*message.Message{first, second, third}, later...), "a", "b")
+	if got := PullFeeds(b.Transport, b.Store, b.Messages).Len(); got != 0 {
+		t.Errorf("expected nothing new once the feed is read, got %d messages", got)
+	}
+}
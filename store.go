@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Store keeps the messages, the followed tags and feeds, the received batches, the pins and the settings of a node
+// SQLiteStore keeps them in the database, MemoryStore only in memory, which is useful for tests
+type Store interface {
+	// Save stores the messages with their source and reports how many were new,
+	// messages that are stored already keep when and where they were first seen
+	Save(msgs *message.Messages, source string) (StoreReport, error)
+	// Load returns all stored messages
+	Load() (*message.Messages, error)
+	// Query returns the stored messages that match the filter
+	Query(f Filter) (*message.Messages, error)
+	// Delete removes the messages with the given stamps and returns how many of them were stored
+	Delete(stamps ...string) (int, error)
+	// FollowedTags returns the followed tags, normalized as FollowTag stores them
+	FollowedTags() ([]string, error)
+	// FollowTag follows a tag, a word without # is taken to be a hashtag
+	FollowTag(tag string) error
+	// UnfollowTag stops following a tag
+	UnfollowTag(tag string) error
+	// RecordBatch remembers that a peer announced a batch, see RecordReceivedBatch
+	RecordBatch(b ReceivedBatch) error
+	// ReceivedBatches returns at most limit of the batches that were announced, the last received first, 0 returns all
+	ReceivedBatches(limit int) ([]ReceivedBatch, error)
+	// LastPublishedBatch returns the CID of the batch that was published last on the topic, empty if there is none
+	LastPublishedBatch(topic string) (string, error)
+	// PublishedStamps returns the stamps of the messages that were published on the topic
+	PublishedStamps(topic string) (map[string]bool, error)
+	// RecordPublishedBatch remembers that the batch was published on the topic with the given CID,
+	// so its messages are not published on the topic again and the next batch links to it, see PublishBatch
+	RecordPublishedBatch(topic, cid string, batch *message.Batch) error
+	// Search returns at most limit of the messages that match the query, the best match first, see SearchMessages
+	Search(query string, limit int) ([]SearchResult, error)
+
+	// FollowedFeeds returns the IPNS names of the followed feeds, sorted by name
+	FollowedFeeds() ([]string, error)
+	// FollowFeed follows a feed, with or without /ipns/ in front of the name
+	FollowFeed(name string) error
+	// UnfollowFeed stops following a feed
+	UnfollowFeed(name string) error
+	// Feed returns how far a followed feed was pulled, see PullFeed
+	Feed(name string) (FeedState, error)
+	// SetFeed remembers how far a followed feed was pulled
+	SetFeed(name string, state FeedState) error
+
+	// SetSaved marks a stored message as saved or not saved, and returns an error if it is not stored
+	SetSaved(stamp string, saved bool) error
+	// Saved returns the stamps of the saved messages
+	Saved() (map[string]bool, error)
+	// Pins maps the stamp of every pinned message to the CID it is pinned under, see SyncPins
+	Pins() (map[string]string, error)
+	// SetPin remembers the CID a message is pinned under
+	SetPin(stamp, cid string) error
+	// RemovePin forgets the pin of a message
+	RemovePin(stamp string) error
+
+	// Trim removes all but the num most important messages that are not saved, and returns how many it removed
+	Trim(num int) (int, error)
+	// Expire removes the messages that are not saved and are expired at now, and returns how many it removed
+	Expire(r Retention, now time.Time) (int, error)
+
+	// Setting returns the value of a setting, or def if it is not set
+	Setting(key, def string) (string, error)
+	// SetSetting stores the value of a setting
+	SetSetting(key, value string) error
+}
+
+// Filter selects messages for Store.Query, a field that is not set matches every message
+type Filter struct {
+	// Tag is a tag the message has, like #golang or @someone
+	Tag string
+	// Since and Until are the times the message is written at or after, and before
+	Since time.Time
+	Until time.Time
+	// Author is the fingerprint of the key the message is signed with, or "anonymous", see Message.Author
+	Author string
+}
+
+// Match checks if the message matches the filter
+func (f Filter) Match(m *message.Message) bool {
+	if f.Tag != "" && !hasTag(m, normalizeTag(f.Tag)) {
+		return false
+	}
+	if !f.Since.IsZero() && m.Timestamp < f.Since.Unix() {
+		return false
+	}
+	if !f.Until.IsZero() && m.Timestamp >= f.Until.Unix() {
+		return false
+	}
+	return f.Author == "" || m.Author() == f.Author
+}
+
+// hasTag checks if the message has the normalized tag
+func hasTag(m *message.Message, tag string) bool {
+	for _, t := range m.Tags() {
+		if t.String() == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTag writes a tag the way it is stored, a tag that can't be parsed is left as it is
+func normalizeTag(tag string) string {
+	if t, ok := message.ParseTag(tag); ok {
+		return t.String()
+	}
+	return tag
+}
+
+// parseFeedName takes the name of a feed to follow, see feedName, and returns an error if there is none
+func parseFeedName(name string) (string, error) {
+	name = feedName(name)
+	if name == "" {
+		return "", fmt.Errorf("no feed given")
+	}
+	return name, nil
+}
+
+// parseFollowedTag normalizes a tag to follow, and returns an error if it is not a valid tag
+func parseFollowedTag(tag string) (string, error) {
+	t, ok := message.ParseTag(tag)
+	if !ok {
+		return "", fmt.Errorf("%q is not a valid tag", tag)
+	}
+	return t.String(), nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// MemoryStore is a Store that only keeps everything in memory
+// It forgets where the messages came from, the zero value is an empty store that is ready to use
+type MemoryStore struct {
+	lock     sync.Mutex
+	msgs     message.Messages
+	tags     []string
+	batches  []ReceivedBatch
+	heads    map[string]string
+	sent     map[string]map[string]bool
+	feeds    map[string]FeedState
+	saved    map[string]bool
+	pins     map[string]string
+	settings map[string]string
+}
+
+// Save adds the messages that are not in the store yet
+func (s *MemoryStore) Save(msgs *message.Messages, source string) (StoreReport, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var report StoreReport
+	msgs.Each(func(m *message.Message) {
+		if s.msgs.Get(m.Stamp()) != nil {
+			report.Known++
+			return
+		}
+		s.msgs.Add(m)
+		report.New++
+	})
+	return report, nil
+}
+
+// Load returns all messages in the store
+func (s *MemoryStore) Load() (*message.Messages, error) {
+	return s.Query(Filter{})
+}
+
+// Query returns the messages in the store that match the filter
+func (s *MemoryStore) Query(f Filter) (*message.Messages, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	msgs := &message.Messages{}
+	s.msgs.Each(func(m *message.Message) {
+		if f.Match(m) {
+			msgs.Add(m)
+		}
+	})
+	return msgs, nil
+}
+
+// Delete removes the messages with the given stamps from the store
+func (s *MemoryStore) Delete(stamps ...string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	deleted := 0
+	for _, stamp := range stamps {
+		if s.msgs.Get(stamp) != nil {
+			s.msgs.Remove(stamp)
+			delete(s.saved, stamp)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// FollowedTags returns the followed tags in the order they were followed
+func (s *MemoryStore) FollowedTags() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.tags...), nil
+}
+
+// FollowTag adds a tag to the followed tags, if it isn't followed yet
+func (s *MemoryStore) FollowTag(tag string) error {
+	tag, err := parseFollowedTag(tag)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tags {
+		if t == tag {
+			return nil
+		}
+	}
+	s.tags = append(s.tags, tag)
+	return nil
+}
+
+// RecordBatch remembers that a peer announced a batch
+// When the peer announced it before, only how often and when it was last announced are updated
+func (s *MemoryStore) RecordBatch(b ReceivedBatch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, known := range s.batches {
+		if known.CID == b.CID && known.Topic == b.Topic && known.Peer == b.Peer {
+			b.Count = known.Count
+			b.Times = known.Times + 1
+			s.batches = append(s.batches[:i], s.batches[i+1:]...)
+			break
+		}
+	}
+	if b.Times == 0 {
+		b.Times = 1
+	}
+	s.batches = append(s.batches, b)
+	return nil
+}
+
+// ReceivedBatches returns the announced batches, the last received first
+func (s *MemoryStore) ReceivedBatches(limit int) ([]ReceivedBatch, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	batches := make([]ReceivedBatch, 0, len(s.batches))
+	for i := len(s.batches) - 1; i >= 0 && (limit <= 0 || len(batches) < limit); i-- {
+		batches = append(batches, s.batches[i])
+	}
+	return batches, nil
+}
+
+// LastPublishedBatch returns the CID of the batch that was published last on the topic
+func (s *MemoryStore) LastPublishedBatch(topic string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.heads[topic], nil
+}
+
+// PublishedStamps returns the stamps of the messages that were published on the topic
+func (s *MemoryStore) PublishedStamps(topic string) (map[string]bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stamps := make(map[string]bool, len(s.sent[topic]))
+	for stamp := range s.sent[topic] {
+		stamps[stamp] = true
+	}
+	return stamps, nil
+}
+
+// RecordPublishedBatch remembers the batch as the last one published on the topic, with its messages
+func (s *MemoryStore) RecordPublishedBatch(topic, cid string, batch *message.Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.heads == nil {
+		s.heads = make(map[string]string)
+		s.sent = make(map[string]map[string]bool)
+	}
+	if s.sent[topic] == nil {
+		s.sent[topic] = make(map[string]bool)
+	}
+	s.heads[topic] = cid
+	batch.Messages.Each(func(m *message.Message) {
+		s.sent[topic][m.Stamp()] = true
+	})
+	return nil
+}
+
+// Search finds the messages in which every term of the query occurs, see parseSearchTerms
+// The relevance of a result is the share of its words that match a term
+func (s *MemoryStore) Search(query string, limit int) ([]SearchResult, error) {
+	var terms []searchTerm
+	for _, term := range parseSearchTerms(query) {
+		// Like in the full text index, a term without words matches every message
+		if len(searchWords(term.text)) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var results []SearchResult
+	s.msgs.Each(func(m *message.Message) {
+		words := searchWords(m.Message)
+		matched := 0
+		for _, term := range terms {
+			n := term.count(words)
+			if n == 0 {
+				return
+			}
+			matched += n
+		}
+		var relevance float64
+		if len(words) > 0 {
+			relevance = float64(matched) / float64(len(words))
+		}
+		results = append(results, SearchResult{Message: m, Relevance: relevance})
+	})
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Relevance != results[j].Relevance {
+			return results[i].Relevance > results[j].Relevance
+		}
+		return results[i].Message.Stamp() < results[j].Message.Stamp()
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// UnfollowTag removes a tag from the followed tags
+func (s *MemoryStore) UnfollowTag(tag string) error {
+	tag = normalizeTag(tag)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, t := range s.tags {
+		if t == tag {
+			s.tags = append(s.tags[:i], s.tags[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// FollowedFeeds returns the followed feeds, sorted by name
+func (s *MemoryStore) FollowedFeeds() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.feeds))
+	for name := range s.feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// FollowFeed adds a feed to the followed feeds, if it isn't followed yet
+func (s *MemoryStore) FollowFeed(name string) error {
+	name, err := parseFeedName(name)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.feeds == nil {
+		s.feeds = make(map[string]FeedState)
+	}
+	if _, ok := s.feeds[name]; !ok {
+		s.feeds[name] = FeedState{}
+	}
+	return nil
+}
+
+// UnfollowFeed removes a feed from the followed feeds
+func (s *MemoryStore) UnfollowFeed(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.feeds, feedName(name))
+	return nil
+}
+
+// Feed returns how far a followed feed was pulled
+func (s *MemoryStore) Feed(name string) (FeedState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.feeds[feedName(name)], nil
+}
+
+// SetFeed remembers how far a followed feed was pulled, a feed that isn't followed is left alone
+func (s *MemoryStore) SetFeed(name string, state FeedState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.feeds[feedName(name)]; ok {
+		s.feeds[feedName(name)] = state
+	}
+	return nil
+}
+
+// SetSaved marks a message in the store as saved or not saved
+func (s *MemoryStore) SetSaved(stamp string, saved bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.msgs.Get(stamp) == nil {
+		return fmt.Errorf("message %s is not in the store", stamp)
+	}
+	if s.saved == nil {
+		s.saved = make(map[string]bool)
+	}
+	if saved {
+		s.saved[stamp] = true
+	} else {
+		delete(s.saved, stamp)
+	}
+	return nil
+}
+
+// Saved returns the stamps of the saved messages
+func (s *MemoryStore) Saved() (map[string]bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved := make(map[string]bool, len(s.saved))
+	for stamp := range s.saved {
+		saved[stamp] = true
+	}
+	return saved, nil
+}
+
+// Pins returns the pinned messages and their CIDs
+func (s *MemoryStore) Pins() (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pins := make(map[string]string, len(s.pins))
+	for stamp, cid := range s.pins {
+		pins[stamp] = cid
+	}
+	return pins, nil
+}
+
+// SetPin remembers the CID a message is pinned under
+func (s *MemoryStore) SetPin(stamp, cid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pins == nil {
+		s.pins = make(map[string]string)
+	}
+	s.pins[stamp] = cid
+	return nil
+}
+
+// RemovePin forgets the pin of a message
+func (s *MemoryStore) RemovePin(stamp string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pins, stamp)
+	return nil
+}
+
+// Trim removes all but the num most important messages that are not saved, by their SortNum
+func (s *MemoryStore) Trim(num int) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	removed := 0
+	for _, m := range s.msgs.MessageList() {
+		if s.saved[m.Stamp()] {
+			continue
+		}
+		if num > 0 {
+			num--
+			continue
+		}
+		s.msgs.Remove(m.Stamp())
+		removed++
+	}
+	return removed, nil
+}
+
+// Expire removes the messages that are not saved and are expired at now
+func (s *MemoryStore) Expire(r Retention, now time.Time) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var gone []string
+	s.msgs.Each(func(m *message.Message) {
+		if !s.saved[m.Stamp()] && r.Expired(m, now) {
+			gone = append(gone, m.Stamp())
+		}
+	})
+	for _, stamp := range gone {
+		s.msgs.Remove(stamp)
+	}
+	return len(gone), nil
+}
+
+// Setting returns the value of a setting, or def if it is not set
+func (s *MemoryStore) Setting(key, def string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if value, ok := s.settings[key]; ok {
+		return value, nil
+	}
+	return def, nil
+}
+
+// SetSetting stores the value of a setting
+func (s *MemoryStore) SetSetting(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.settings == nil {
+		s.settings = make(map[string]string)
+	}
+	s.settings[key] = value
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// SQLiteStore is a Store that keeps everything in the tables of the database
+// The database has to be migrated already, see OpenDatabase
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+// Save stores the messages in one transaction, see StoreMessages
+func (s SQLiteStore) Save(msgs *message.Messages, source string) (StoreReport, error) {
+	return StoreMessages(s.DB, msgs, source)
+}
+
+// Load returns all messages in the database
+func (s SQLiteStore) Load() (*message.Messages, error) {
+	return selectMessages(s.DB, "SELECT "+messageColumns+" FROM messages")
+}
+
+// Query returns the messages in the database that match the filter
+func (s SQLiteStore) Query(f Filter) (*message.Messages, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE 1"
+	var args []interface{}
+	if f.Tag != "" {
+		query += " AND hash IN (SELECT hash FROM message_tags WHERE tag = ?)"
+		args = append(args, normalizeTag(f.Tag))
+	}
+	if !f.Since.IsZero() {
+		query += " AND timestamp >= ?"
+		args = append(args, f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		query += " AND timestamp < ?"
+		args = append(args, f.Until.Unix())
+	}
+	msgs, err := selectMessages(s.DB, query, args...)
+	if err != nil || f.Author == "" {
+		return msgs, err
+	}
+	// The fingerprint of the author is not stored, so it is compared here
+	authored := &message.Messages{}
+	msgs.Each(func(m *message.Message) {
+		if f.Match(m) {
+			authored.Add(m)
+		}
+	})
+	return authored, nil
+}
+
+// Delete removes the messages with the given stamps from the database in one transaction
+func (s SQLiteStore) Delete(stamps ...string) (int, error) {
+	var deleted int64
+	err := withTx(s.DB, func(tx *sql.Tx) error {
+		for _, stamp := range stamps {
+			result, err := tx.Exec("DELETE FROM messages WHERE hash = ?", stamp)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// FollowedTags returns the tags in the table "followed_tags"
+func (s SQLiteStore) FollowedTags() ([]string, error) {
+	return queryColumn(s.DB, "SELECT tag FROM followed_tags")
+}
+
+// FollowTag adds a tag to the table "followed_tags", see FollowTag
+func (s SQLiteStore) FollowTag(tag string) error {
+	return FollowTag(s.DB, tag)
+}
+
+// UnfollowTag removes a tag from the table "followed_tags"
+func (s SQLiteStore) UnfollowTag(tag string) error {
+	return UnfollowTag(s.DB, tag)
+}
+
+// RecordBatch remembers that a peer announced a batch in the table "batches"
+func (s SQLiteStore) RecordBatch(b ReceivedBatch) error {
+	return RecordReceivedBatch(s.DB, b)
+}
+
+// ReceivedBatches returns the batches in the table "batches", the last received first
+func (s SQLiteStore) ReceivedBatches(limit int) ([]ReceivedBatch, error) {
+	return GetReceivedBatches(s.DB, limit)
+}
+
+// LastPublishedBatch returns the CID of the batch in the table "published_batches" that was published last on the topic
+func (s SQLiteStore) LastPublishedBatch(topic string) (string, error) {
+	var cid string
+	err := s.DB.QueryRow("SELECT cid FROM published_batches WHERE topic = ? ORDER BY rowid DESC LIMIT 1", topic).Scan(&cid)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return cid, err
+}
+
+// PublishedStamps returns the stamps in the table "published_messages" of the messages that were published on the topic
+func (s SQLiteStore) PublishedStamps(topic string) (map[string]bool, error) {
+	hashes, err := queryColumn(s.DB, "SELECT hash FROM published_messages WHERE topic = ?", topic)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[string]bool)
+	for _, hash := range hashes {
+		stamps[hash] = true
+	}
+	return stamps, nil
+}
+
+// RecordPublishedBatch adds the batch to the table "published_batches" and its messages to "published_messages"
+// in one transaction
+func (s SQLiteStore) RecordPublishedBatch(topic, cid string, batch *message.Batch) error {
+	return withTx(s.DB, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO published_batches(cid, topic, previous, count, published_at) VALUES(?, ?, ?, ?, ?)",
+			cid, topic, batch.Previous, batch.Messages.Len(), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		batch.Messages.Each(func(m *message.Message) {
+			if err == nil {
+				_, err = tx.Exec("INSERT OR REPLACE INTO published_messages(topic, hash, cid) VALUES(?, ?, ?)", topic, m.Stamp(), cid)
+			}
+		})
+		return err
+	})
+}
+
+// Search uses the full text index messages_fts to find the messages that match the query, see ParseSearchQuery
+// The relevance of a result is its bm25 rank
+func (s SQLiteStore) Search(query string, limit int) ([]SearchResult, error) {
+	rows, err := s.DB.Query(`SELECT `+prefixColumns("messages", messageColumns)+`, bm25(messages_fts)
+		FROM messages_fts JOIN messages ON messages.rowid = messages_fts.rowid
+		WHERE messages_fts MATCH ? ORDER BY bm25(messages_fts) LIMIT ?`, ParseSearchQuery(query), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		_, m, err := scanMessage(rows, &r.Relevance)
+		if err != nil {
+			return nil, err
+		}
+		// bm25 is negative, the lower the better
+		r.Message, r.Relevance = m, -r.Relevance
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// FollowedFeeds returns the names in the table "followed_feeds"
+func (s SQLiteStore) FollowedFeeds() ([]string, error) {
+	return queryColumn(s.DB, "SELECT name FROM followed_feeds ORDER BY name")
+}
+
+// FollowFeed adds an IPNS name to the table "followed_feeds"
+func (s SQLiteStore) FollowFeed(name string) error {
+	name, err := parseFeedName(name)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec("INSERT OR IGNORE INTO followed_feeds(name) VALUES(?)", name)
+	return err
+}
+
+// UnfollowFeed removes an IPNS name from the table "followed_feeds"
+func (s SQLiteStore) UnfollowFeed(name string) error {
+	_, err := s.DB.Exec("DELETE FROM followed_feeds WHERE name = ?", feedName(name))
+	return err
+}
+
+// Feed returns how far a feed in the table "followed_feeds" was pulled, nothing for a feed that isn't followed
+func (s SQLiteStore) Feed(name string) (FeedState, error) {
+	var state FeedState
+	err := s.DB.QueryRow("SELECT COALESCE(last_cid, ''), COALESCE(resume_cid, ''), COALESCE(resume_head, '') FROM followed_feeds WHERE name = ?",
+		feedName(name)).Scan(&state.Last, &state.Resume, &state.ResumeHead)
+	if err == sql.ErrNoRows {
+		return FeedState{}, nil
+	}
+	return state, err
+}
+
+// SetFeed updates how far a feed in the table "followed_feeds" was pulled, and when
+func (s SQLiteStore) SetFeed(name string, state FeedState) error {
+	_, err := s.DB.Exec("UPDATE followed_feeds SET last_cid = NULLIF(?, ''), resume_cid = NULLIF(?, ''), resume_head = NULLIF(?, ''), pulled_at = ? WHERE name = ?",
+		state.Last, state.Resume, state.ResumeHead, time.Now().Unix(), feedName(name))
+	return err
+}
+
+// SetSaved marks the message in the database with the given stamp as saved or not saved
+func (s SQLiteStore) SetSaved(stamp string, saved bool) error {
+	result, err := s.DB.Exec("UPDATE messages SET saved = ? WHERE hash = ?", saved, stamp)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("message %s is not in the database", stamp)
+	}
+	return nil
+}
+
+// Saved returns the stamps of the saved messages in the database
+func (s SQLiteStore) Saved() (map[string]bool, error) {
+	stamps, err := queryColumn(s.DB, "SELECT hash FROM messages WHERE saved = 1")
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[string]bool)
+	for _, stamp := range stamps {
+		saved[stamp] = true
+	}
+	return saved, nil
+}
+
+// Pins returns the pins in the table "pins"
+func (s SQLiteStore) Pins() (map[string]string, error) {
+	rows, err := s.DB.Query("SELECT hash, cid FROM pins")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pins := make(map[string]string)
+	for rows.Next() {
+		var hash, cid string
+		if err := rows.Scan(&hash, &cid); err != nil {
+			return nil, err
+		}
+		pins[hash] = cid
+	}
+	return pins, rows.Err()
+}
+
+// SetPin adds a pin to the table "pins"
+func (s SQLiteStore) SetPin(stamp, cid string) error {
+	_, err := s.DB.Exec("INSERT OR REPLACE INTO pins(hash, cid, pinned_at) VALUES(?, ?, ?)", stamp, cid, time.Now().Unix())
+	return err
+}
+
+// RemovePin removes a pin from the table "pins"
+func (s SQLiteStore) RemovePin(stamp string) error {
+	_, err := s.DB.Exec("DELETE FROM pins WHERE hash = ?", stamp)
+	return err
+}
+
+// Trim removes the least important messages from the database, see TrimDatabaseTo
+func (s SQLiteStore) Trim(num int) (int, error) {
+	removed, err := TrimDatabaseTo(s.DB, num)
+	return int(removed), err
+}
+
+// Expire removes the expired messages from the database in one transaction, using the "importance" column
+func (s SQLiteStore) Expire(r Retention, now time.Time) (int, error) {
+	if r.Period <= 0 {
+		return 0, nil
+	}
+	var removed int64
+	err := withTx(s.DB, func(tx *sql.Tx) error {
+		if err := updateImportance(tx, now); err != nil {
+			return err
+		}
+		// A message has expired when its importance plus the period has passed, see Importance
+		// Messages from the future have no importance yet, but they don't expire before their time has come
+		result, err := tx.Exec("DELETE FROM messages WHERE saved = 0 AND importance < ? AND timestamp <= ?", now.Add(-r.Period).Unix(), now.Unix())
+		if err != nil {
+			return err
+		}
+		removed, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+// Setting returns the value of a setting in the table "settings", or def if it is not set
+func (s SQLiteStore) Setting(key, def string) (string, error) {
+	var value string
+	err := s.DB.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	return value, nil
+}
+
+// SetSetting stores the value of a setting in the table "settings"
+func (s SQLiteStore) SetSetting(key, value string) error {
+	_, err := s.DB.Exec("INSERT OR REPLACE INTO settings(key, value) VALUES(?, ?)", key, value)
+	return err
+}
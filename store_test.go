@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Test that both stores save, query, delete and expire messages and keep the followed tags and feeds,
+// the received and published batches and the settings the same way
+func TestStores(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) {
+		db := newTestDB(t)
+		testStore(t, SQLiteStore{db})
+	})
+	t.Run("Memory", func(t *testing.T) {
+		testStore(t, &MemoryStore{})
+	})
+}
+
+func testStore(t *testing.T, store Store) {
+	id, err := message.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old, _ := message.New("old news about #go", 0, now.Add(-48*time.Hour).Unix(), time.Minute)
+	recent, _ := message.New("recent news about #go", 0, now.Unix(), time.Minute)
+	signed := &message.Message{Version: message.CurrentVersion, Message: "signed news", Timestamp: now.Unix()}
+	id.Sign(signed)
+
+	report, err := store.Save(messagesOf(old, recent), SourceLocal)
+	if err != nil || report.New != 2 {
+		t.Fatalf("expected 2 new messages, got %v %v", report, err)
+	}
+	report, err = store.Save(messagesOf(recent, signed), TopicSource("OLN"))
+	if err != nil || report.New != 1 || report.Known != 1 {
+		t.Fatalf("expected 1 new and 1 known message, got %v %v", report, err)
+	}
+	if all, err := store.Load(); err != nil || all.Len() != 3 {
+		t.Fatalf("expected 3 messages, got %v %v", stamps(all), err)
+	}
+
+	for _, c := range []struct {
+		filter Filter
+		want   []*message.Message
+	}{
+		{Filter{Tag: "Go"}, []*message.Message{old, recent}},
+		{Filter{Since: now.Add(-time.Hour)}, []*message.Message{recent, signed}},
+		{Filter{Tag: "#go", Until: now.Add(-time.Hour)}, []*message.Message{old}},
+		{Filter{Author: id.Fingerprint()}, []*message.Message{signed}},
+		{Filter{Author: "anonymous", Since: now.Add(-time.Hour)}, []*message.Message{recent}},
+	} {
+		got, err := store.Query(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := stamps(messagesOf(c.want...)); !equalStrings(stamps(got), want) {
+			t.Errorf("expected %v for %+v, got %v", want, c.filter, stamps(got))
+		}
+	}
+
+	if deleted, err := store.Delete(old.Stamp(), "unknown"); err != nil || deleted != 1 {
+		t.Errorf("expected 1 deleted message, got %d %v", deleted, err)
+	}
+	if got, _ := store.Query(Filter{Tag: "#go"}); !equalStrings(stamps(got), stamps(messagesOf(recent))) {
+		t.Errorf("expected only the recent message to be left with #go, got %v", stamps(got))
+	}
+
+	for _, tag := range []string{"GoLang", "#golang", "@Someone"} {
+		if err := store.FollowTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.FollowTag("not a tag"); err == nil {
+		t.Error("expected an error for an invalid tag")
+	}
+	store.UnfollowTag("@SOMEONE")
+	if tags, err := store.FollowedTags(); err != nil || !equalStrings(tags, []string{"#golang"}) {
+		t.Errorf("expected only #golang to be followed, got %v %v", tags, err)
+	}
+
+	for _, b := range []ReceivedBatch{
+		{CID: "first", Topic: "OLN", Peer: "a", Count: 2, ReceivedAt: now.Add(-time.Minute)},
+		{CID: "second", Topic: "OLN", Peer: "b", Count: 1, ReceivedAt: now.Add(-time.Minute)},
+		{CID: "first", Topic: "OLN", Peer: "a", Count: 2, ReceivedAt: now},
+	} {
+		if err := store.RecordBatch(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches, err := store.ReceivedBatches(0)
+	if err != nil || len(batches) != 2 {
+		t.Fatalf("expected 2 received batches, got %v %v", batches, err)
+	}
+	if last, err := store.ReceivedBatches(1); err != nil || len(last) != 1 || last[0].CID != "first" {
+		t.Errorf("expected only the last received batch, got %v %v", last, err)
+	}
+	if got := batches[0]; got.CID != "first" || got.Times != 2 || got.Count != 2 || got.ReceivedAt.Unix() != now.Unix() {
+		t.Errorf("expected the first batch to be received twice, last at %v, got %v", now, got)
+	}
+
+	if head, err := store.LastPublishedBatch("OLN"); err != nil || head != "" {
+		t.Errorf("expected nothing to be published yet, got %q %v", head, err)
+	}
+	for _, b := range []struct {
+		cid   string
+		batch message.Batch
+	}{
+		{"one", message.Batch{Messages: messagesOf(old)}},
+		{"two", message.Batch{Previous: "one", Messages: messagesOf(recent)}},
+	} {
+		if err := store.RecordPublishedBatch("OLN", b.cid, &b.batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if head, err := store.LastPublishedBatch("OLN"); err != nil || head != "two" {
+		t.Errorf("expected the last published batch to be two, got %q %v", head, err)
+	}
+	if published, err := store.PublishedStamps("OLN"); err != nil || len(published) != 2 || !published[old.Stamp()] || !published[recent.Stamp()] {
+		t.Errorf("expected both messages to be published on OLN, got %v %v", published, err)
+	}
+	if published, err := store.PublishedStamps("oln-#golang"); err != nil || len(published) != 0 {
+		t.Errorf("expected nothing to be published on another topic, got %v %v", published, err)
+	}
+
+	for _, name := range []string{"/ipns/b", "a", "c"} {
+		if err := store.FollowFeed(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.FollowFeed(" /ipns/ "); err == nil {
+		t.Error("expected an error for an empty feed name")
+	}
+	store.UnfollowFeed("/ipns/c")
+	if feeds, err := store.FollowedFeeds(); err != nil || !equalStrings(feeds, []string{"a", "b"}) {
+		t.Errorf("expected the feeds a and b, got %v %v", feeds, err)
+	}
+	want := FeedState{Last: "old", Resume: "next", ResumeHead: "head"}
+	if err := store.SetFeed("/ipns/a", want); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := store.Feed("a"); err != nil || state != want {
+		t.Errorf("expected the feed to be pulled up to %+v, got %+v %v", want, state, err)
+	}
+
+	if value, err := store.Setting("color", "blue"); err != nil || value != "blue" {
+		t.Errorf("expected the default of a setting that is not set, got %q %v", value, err)
+	}
+	store.SetSetting("color", "red")
+	if value, _ := store.Setting("color", "blue"); value != "red" {
+		t.Errorf("expected the setting to be stored, got %q", value)
+	}
+
+	// The recent message is saved, so only the signed one expires
+	if err := store.SetSaved(recent.Stamp(), true); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := store.Saved(); err != nil || len(saved) != 1 || !saved[recent.Stamp()] {
+		t.Errorf("expected only the recent message to be saved, got %v %v", saved, err)
+	}
+	if expired, err := store.Expire(Retention{Period: time.Hour}, now.Add(24*time.Hour)); err != nil || expired != 1 {
+		t.Errorf("expected 1 expired message, got %d %v", expired, err)
+	}
+	if got, _ := store.Load(); !equalStrings(stamps(got), stamps(messagesOf(recent))) {
+		t.Errorf("expected only the saved message to be left, got %v", stamps(got))
+	}
+}
+
+// equalStrings checks if the lists have the same strings in the same order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
-	"strings"
 
 	"git.kiefte.eu/lapingvino/infodump/message"
-	shell "github.com/ipfs/go-ipfs-api"
+	"git.kiefte.eu/lapingvino/infodump/transport"
 )
 
 // A menu for the several parts of Sync:
@@ -13,6 +12,7 @@ import (
 // reading messages from the local database
 // reading messages from the network
 // writing messages to the network
+// publishing the feed of this node and pulling the followed feeds
 func SyncMenu() {
 	// Present the user with a menu
 	Menu([]MenuElements{
@@ -20,6 +20,8 @@ func SyncMenu() {
 		{"Read Messages from Database", ReadMessagesFromDatabase},
 		{"Read Messages from Network", ReadMessagesFromNetwork},
 		{"Write Messages to Network", WriteMessagesToNetwork},
+		{"Publish Own Feed", PublishOwnFeed},
+		{"Pull Followed Feeds", PullFollowedFeeds},
 		{"Back", func() {}},
 	})
 }
@@ -30,22 +32,26 @@ func SyncMenu() {
 // SaveMessagesToDatabase saves the messages in LocalMessages to the database
 func SaveMessagesToDatabase() {
 	// Update the database with the messages in LocalMessages
-	db := GetDatabase()
-	// Put the messages in the database
-	LocalMessages.Each(func(m *message.Message) {
-		_, err := db.Exec("INSERT INTO messages(hash, message, nonce, timestamp) VALUES(?,?,?,?)", m.Stamp(), m.Message, m.Nonce, m.Timestamp)
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("Message", m.Stamp(), "saved to database")
-		}
-	})
+	fmt.Println("Saved", SaveMessages(GetStore(), &LocalMessages, SourceLocal))
+}
+
+// SaveMessages puts the messages in the store, see Store.Save, and reports how many of them were new
+// Nothing is saved if one of them can't be
+func SaveMessages(store Store, msgs *message.Messages, source string) StoreReport {
+	report, err := store.Save(msgs, source)
+	if err != nil {
+		fmt.Println("Error saving messages:", err)
+	}
+	return report
 }
 
 // ReadMessagesFromDatabase reads the messages from the database and adds them to LocalMessages
 func ReadMessagesFromDatabase() {
 	// Get the messages from the database
-	messages := GetMessagesFromDatabase(GetDatabase())
+	messages, err := GetStore().Load()
+	if err != nil {
+		fmt.Println(err)
+	}
 	// Add the messages to LocalMessages
 	LocalMessages.AddMany(messages)
 }
@@ -56,84 +62,99 @@ func ReadMessagesFromNetwork() {
 	// Add the messages to LocalMessages
 	fmt.Println("Enter the CID of the messages to read: ")
 	cid := Readline()
-	messages, err := message.MessagesFromIPFS(cid)
+	valid, report, err := PullMessages(Network, cid, &LocalMessages)
 	if err != nil {
 		fmt.Println(err)
-	} else {
-		LocalMessages.AddMany(messages)
+		return
 	}
+	fmt.Println(report)
+	LocalMessages.AddMany(valid)
 }
 
-// WriteMessagesToNetwork writes the messages in LocalMessages to the IPFS network
-func WriteMessagesToNetwork() {
-	// Create an IPFS shell to later publish the messages to via PubSub
-	myIPFS := shell.NewShell(message.IPFSGateway)
-	// Add the messages to the IPFS network
-	cid, err := LocalMessages.AddToIPFS()
+// PullMessages gets the messages with the given CID from the IPFS network through the transport
+// Only the messages that are not in known are fetched, see message.BatchFromIPFS; known can be nil
+// The messages with a forged or too weak stamp are dropped, the report tells which ones
+func PullMessages(t transport.Transport, cid string, known *message.Messages) (*message.Messages, message.Report, error) {
+	batch, err := message.BatchFromIPFS(t, cid, known)
 	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Println("Messages synced to IPFS: ", cid)
+		return nil, message.Report{}, err
 	}
-	// Publish the CID of LocalMessages to the OLN tag
-	err = myIPFS.PubSubPublish("OLN", cid)
+	valid, report := message.VerifyAll(batch.Messages)
+	return valid, report, nil
+}
+
+// WriteMessagesToNetwork writes the messages in LocalMessages that are not on the IPFS network yet to it
+func WriteMessagesToNetwork() {
+	_, err := PublishMessages(Network, GetStore(), &LocalMessages)
 	if err != nil {
 		fmt.Println(err)
-	} else {
-		fmt.Println("Published CID", cid, "to the main network")
 	}
-	// Define what is considered a tag by regex
-	tagDefinition := []string{
-		// Hashtags
-		"#[a-zA-Z0-9]+",
-		// Mentions
-		"@[a-zA-Z0-9]+",
-		// Links
-		"https?://[a-zA-Z0-9./]+",
-	}
-	// Split each message on spaces and map the resulting strings
-	// to the message stamp
-	messages := make(map[string][]*message.Message)
-	LocalMessages.Each(func(m *message.Message) {
-		tags := strings.Split(m.Message, " ")
-		itertags:		
-		for _, tag := range tags {
-			// Check if the tag matches any of the tag definitions
-			// if not, continue to the next tag
-			for _, regex := range tagDefinition {
-				if !strings.Contains(tag, regex) {
-					continue itertags
+}
+
+// PublishMessages publishes the messages that were not published before, all of them on the topic "OLN",
+// and per tag on the topics of the tag, see message.Tag.Topics
+// Every topic gets a batch of its own, see PublishBatch
+// The transport is used to add the messages and to publish them, the store keeps track of what is published
+// It returns the CID of the batch on "OLN"
+func PublishMessages(t transport.Transport, store Store, msgs *message.Messages) (string, error) {
+	// Map the topics of the tags of each message to the messages that have them
+	topics := make(map[string]*message.Messages)
+	msgs.Each(func(m *message.Message) {
+		for _, tag := range m.Tags() {
+			for _, topic := range tag.Topics() {
+				if topics[topic] == nil {
+					topics[topic] = &message.Messages{}
 				}
+				topics[topic].Add(m)
 			}
-			// If the tag matches any of the tag definitions,
-			// add the message to the messages map
-			messages[tag] = append(messages[tag], m)
 		}
 	})
-	// Create a new set of messages per tag and send them over PubSub
-	// Per message, invoke Add on the tags map entry
-	tags := make(map[string]*message.Messages)
-	for tag, messages := range messages {
-		if tags[tag] == nil {
-			tags[tag] = &message.Messages{}
-		}
-		for _, m := range messages {
-			tags[tag].Add(m)
-		}
-		// Publish the messages to the IPFS network and get a CID
-		cid, err := tags[tag].AddToIPFS()
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("Messages synced to IPFS: ", cid)
-		}
-		// Publish the messages via PubSub on the IPFS shell
-		err = myIPFS.PubSubPublish("oln-"+tag, cid)
+	cid, err := PublishBatch(t, store, "OLN", msgs)
+	if err != nil {
+		return cid, err
+	}
+	for topic, tagged := range topics {
+		_, err := PublishBatch(t, store, topic, tagged)
 		if err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("Messages published to the rest of the network for tag: ", tag)
+			fmt.Println("Error publishing on", topic+":", err)
 		}
 	}
+	return cid, nil
+}
 
+// PublishBatch publishes the messages that were not published on the topic yet as a new batch,
+// linked to the batch that was published on the topic before
+// If there is nothing new, the last batch is announced again, so peers that joined later can find the chain
+// It returns the CID of the announced batch, which is empty if nothing was ever published on the topic
+func PublishBatch(t transport.Transport, store Store, topic string, msgs *message.Messages) (string, error) {
+	head, err := store.LastPublishedBatch(topic)
+	if err != nil {
+		return "", err
+	}
+	published, err := store.PublishedStamps(topic)
+	if err != nil {
+		return "", err
+	}
+	batch := message.Batch{Previous: head, Messages: &message.Messages{}}
+	msgs.Each(func(m *message.Message) {
+		if !published[m.Stamp()] {
+			batch.Messages.Add(m)
+		}
+	})
+	if batch.Messages.Len() == 0 {
+		if head == "" {
+			return "", nil
+		}
+		return head, t.Publish(topic, head)
+	}
+	cid, err := batch.AddToIPFS(t)
+	if err != nil {
+		return "", err
+	}
+	err = t.Publish(topic, cid)
+	if err != nil {
+		return cid, err
+	}
+	fmt.Println("Published", batch.Messages.Len(), "new messages on", topic+":", cid)
+	return cid, store.RecordPublishedBatch(topic, cid, &batch)
 }
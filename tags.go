@@ -4,18 +4,32 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
 )
 
 func ConfigureFollowedTags() {
-	db := GetDatabase()
 	fmt.Println("At the moment you follow the following tags:")
 	// Get the tags that the user is following
-	tags := GetFollowedTags(db)
+	tags, err := GetStore().FollowedTags()
+	if err != nil {
+		fmt.Println(err)
+	}
 	// Show the tags
 	for _, tag := range tags {
 		fmt.Print(tag, " ")
 	}
 	fmt.Println()
+	Menu([]MenuElements{
+		{"Follow or Unfollow Tags", EditFollowedTags},
+		{"Follow Area", FollowAreaMenu},
+		{"Back", func() {}},
+	})
+}
+
+// EditFollowedTags asks for tags to follow and to stop following
+func EditFollowedTags() {
+	store := GetStore()
 	fmt.Println("Enter the tags you want to follow, separated by spaces\nTo remove tags, prefix them with a minus sign: ")
 	newtags := Readline()
 	// Split the tags into an array and insert them into database DB
@@ -23,34 +37,95 @@ func ConfigureFollowedTags() {
 	tagArray := strings.Split(newtags, " ")
 	for _, tag := range tagArray {
 		tag = strings.Trim(tag, " \n")
+		if tag == "" {
+			continue
+		}
+		var err error
 		if !strings.HasPrefix(tag, "-") {
-			_, err := db.Exec("INSERT INTO followed_tags(tag) VALUES(?)", tag)
-			if err != nil {
-				fmt.Println(err)
-			}
+			err = store.FollowTag(tag)
 		} else {
-			_, err := db.Exec("DELETE FROM followed_tags WHERE tag=?", tag[1:])
-			if err != nil {
-				fmt.Println(err)
-			}
+			err = store.UnfollowTag(tag[1:])
+		}
+		if err != nil {
+			fmt.Println(err)
 		}
 	}
 }
 
-func GetFollowedTags(db *sql.DB) []string {
-	// Get the tags from the database
-	rows, err := db.Query("SELECT tag FROM followed_tags")
+// FollowAreaMenu asks for a place and a distance and follows the area around it
+func FollowAreaMenu() {
+	fmt.Println("Enter the place to follow, as a geohash like u173z or as latitude,longitude like 52.37,4.89: ")
+	place := Readline()
+	fmt.Println("How many km around it do you want to follow?")
+	var km float64
+	fmt.Scanln(&km)
+	tag, err := FollowArea(GetStore(), place, km)
 	if err != nil {
 		fmt.Println(err)
+		return
+	}
+	fmt.Println("Following", tag, "- restart the listener to receive its messages")
+}
+
+// FollowArea follows the messages that are tagged with a place in the area of the given size around a place
+// The area is the geohash cell that fits the size best, see message.GeohashPrecision
+// It returns the location tag that is followed in the store
+func FollowArea(store Store, place string, km float64) (string, error) {
+	p, ok := message.ParsePoint(place)
+	if !ok {
+		return "", fmt.Errorf("%q is not a geohash or a latitude,longitude", place)
+	}
+	tag := message.GeohashTag(p.Geohash(message.GeohashPrecision(km))).String()
+	return tag, store.FollowTag(tag)
+}
+
+// execer is what a database and a transaction have in common to change the database
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// FollowTag adds a tag to the table "followed_tags"
+// The tag is normalized first, a word without # is taken to be a hashtag
+func FollowTag(db *sql.DB, tag string) error {
+	return followTag(db, tag)
+}
+
+func followTag(db execer, tag string) error {
+	tag, err := parseFollowedTag(tag)
+	if err != nil {
+		return err
 	}
-	var tags []string
-	for rows.Next() {
-		var tag string
-		err = rows.Scan(&tag)
+	_, err = db.Exec("INSERT INTO followed_tags(tag) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM followed_tags WHERE tag = ?)", tag, tag)
+	return err
+}
+
+// UnfollowTag removes a tag from the table "followed_tags"
+func UnfollowTag(db *sql.DB, tag string) error {
+	_, err := db.Exec("DELETE FROM followed_tags WHERE tag=?", normalizeTag(tag))
+	return err
+}
+
+// insertTags stores the tags of the message with the given hash in the table "message_tags"
+func insertTags(db execer, hash string, tags []message.Tag) error {
+	for _, tag := range tags {
+		_, err := db.Exec("INSERT OR IGNORE INTO message_tags(hash, kind, tag) VALUES(?, ?, ?)", hash, tag.Kind.String(), tag.String())
 		if err != nil {
-			fmt.Println(err)
+			return err
 		}
-		tags = append(tags, tag)
+	}
+	return nil
+}
+
+// GetMessagesWithTag returns the messages in the database that have the tag
+func GetMessagesWithTag(db *sql.DB, tag string) *message.Messages {
+	return queryMessages(db, "SELECT "+messageColumns+" FROM messages WHERE hash IN (SELECT hash FROM message_tags WHERE tag = ?)", normalizeTag(tag))
+}
+
+// GetFollowedTags returns the tags in the table "followed_tags", errors are shown and skipped
+func GetFollowedTags(db *sql.DB) []string {
+	tags, err := queryColumn(db, "SELECT tag FROM followed_tags")
+	if err != nil {
+		fmt.Println(err)
 	}
 	return tags
 }
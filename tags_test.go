@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// Test that followed tags are normalized and only stored once
+func TestFollowTag(t *testing.T) {
+	db := newTestDB(t)
+	for _, tag := range []string{"GoLang", "#golang", "@Someone"} {
+		if err := FollowTag(db, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := FollowTag(db, "not a tag"); err == nil {
+		t.Error("expected an error for an invalid tag")
+	}
+	if tags := GetFollowedTags(db); len(tags) != 2 || tags[0] != "#golang" || tags[1] != "@someone" {
+		t.Errorf("expected #golang and @someone, got %v", tags)
+	}
+	UnfollowTag(db, "#GOLANG")
+	if tags := GetFollowedTags(db); len(tags) != 1 {
+		t.Errorf("expected only @someone to be left, got %v", tags)
+	}
+}
+
+// Test that the tags of messages are stored with them, and removed with them
+func TestMessageTags(t *testing.T) {
+	db := newTestDB(t)
+	weak, _ := message.New("weak news about #Go", 0, time.Now().Unix(), time.Minute)
+	strong, _ := message.New("strong news about #go and @someone", 16, time.Now().Unix(), time.Minute)
+	SaveMessages(SQLiteStore{db}, messagesOf(weak, strong), SourceLocal)
+
+	if got := stamps(GetMessagesWithTag(db, "go")); len(got) != 2 {
+		t.Errorf("expected both messages with #go, got %v", got)
+	}
+	if got := GetMessagesWithTag(db, "@someone"); got.Get(strong.Stamp()) == nil || len(got.MessageList()) != 1 {
+		t.Errorf("expected only the strong message with @someone, got %v", stamps(got))
+	}
+	if removed, err := TrimDatabaseTo(db, 1); err != nil || removed != 1 {
+		t.Fatalf("expected the weak message to be trimmed, removed %d %v", removed, err)
+	}
+	if got := stamps(GetMessagesFromDatabase(db)); len(got) != 1 || got[0] != strong.Stamp() {
+		t.Errorf("expected only the strong message to be left, got %v", got)
+	}
+	if removed, _ := TrimDatabaseTo(db, 1); removed != 0 {
+		t.Errorf("expected nothing to be trimmed the second time, removed %d", removed)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM message_tags WHERE hash = ?", weak.Stamp()).Scan(&left)
+	if left != 0 {
+		t.Errorf("expected the tags of the trimmed message to be removed, %d are left", left)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/message"
+)
+
+// ReplyCounts maps the stamp of every message with replies to the number of replies,
+// counting both LocalMessages and the database if it is set
+func ReplyCounts() map[string]int {
+	counts := LocalMessages.ReplyCounts()
+	if DB != nil {
+		for stamp, n := range GetReplyCountsFromDatabase(DB) {
+			if n > counts[stamp] {
+				counts[stamp] = n
+			}
+		}
+	}
+	return counts
+}
+
+// PrintThread shows a conversation as a tree, every reply indented below the message it replies to
+func PrintThread(t *message.Thread) {
+	t.Walk(func(depth int, m *message.Message) {
+		indent := strings.Repeat("    ", depth)
+		fmt.Printf("%s%.12s by %s at %s\n", indent, m.Stamp(), m.Author(), time.Unix(m.Timestamp, 0).Format(time.RFC3339))
+		for _, line := range strings.Split(m.Message, "\n") {
+			fmt.Println(indent + "  " + line)
+		}
+	})
+}
+
+// ReadThreads shows all conversations in LocalMessages as trees, 10 at a time
+func ReadThreads() {
+	threads := LocalMessages.Threads()
+	for i, t := range threads {
+		PrintThread(t)
+		fmt.Println()
+		if i%10 == 9 {
+			fmt.Println("Press enter to continue... Type anything to stop")
+			contp := Readline()
+			if contp != "" {
+				return
+			}
+		}
+	}
+}
+
+// FindMessage looks up a message in LocalMessages by the start of its stamp, or in the database if it is not there
+// If there is no single match, it tells the user and returns nil
+func FindMessage(prefix string) *message.Message {
+	if prefix == "" {
+		fmt.Println("No message hash given")
+		return nil
+	}
+	found := LocalMessages.Find(prefix)
+	// After a restart most messages are only in the database
+	if len(found) == 0 && DB != nil {
+		found = FindMessagesInDatabase(DB, prefix).MessageList()
+	}
+	switch len(found) {
+	case 0:
+		fmt.Println("No message found starting with", prefix)
+		return nil
+	case 1:
+		return found[0]
+	default:
+		fmt.Println("More than one message starts with", prefix+", please type more of the hash")
+		return nil
+	}
+}
+
+// OpenConversation shows the whole conversation a message is part of
+// The messages it replies to and the replies stored in the database are loaded into LocalMessages first
+func OpenConversation(prefix string) {
+	m := FindMessage(prefix)
+	if m == nil {
+		return
+	}
+	if DB != nil {
+		LocalMessages.AddMany(GetAncestorsFromDatabase(DB, m.Stamp()))
+	}
+	root := LocalMessages.Root(m.Stamp())
+	if DB != nil {
+		LocalMessages.AddMany(GetThreadFromDatabase(DB, root))
+	}
+	PrintThread(LocalMessages.Thread(root))
+	fmt.Println("Do you want to reply? Type the start of the hash of the message to reply to, or nothing to go back")
+	answer := Readline()
+	if answer != "" {
+		if parent := FindMessage(answer); parent != nil {
+			ComposeMessage(parent.Stamp())
+		}
+	}
+}
+
+// OpenConversationMenu asks for a message and shows the conversation it is part of
+func OpenConversationMenu() {
+	fmt.Println("Enter the start of the hash of a message: ")
+	OpenConversation(Readline())
+}
+
+// WriteReply asks for a message to reply to and lets the user write the reply
+func WriteReply() {
+	fmt.Println("Enter the start of the hash of the message to reply to: ")
+	parent := FindMessage(Readline())
+	if parent == nil {
+		return
+	}
+	fmt.Println("Replying to:")
+	fmt.Println(parent)
+	ComposeMessage(parent.Stamp())
+}
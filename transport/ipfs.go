@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// IPFS is a Transport that talks to an IPFS daemon through its HTTP API
+// The daemon needs to run with --enable-pubsub-experiment
+type IPFS struct {
+	shell *shell.Shell
+}
+
+// NewIPFS creates a Transport for the IPFS daemon with the given API address, e.g. http://localhost:5001
+func NewIPFS(gateway string) *IPFS {
+	return &IPFS{shell: shell.NewShell(gateway)}
+}
+
+// Add stores the content on IPFS and returns its CID
+func (t *IPFS) Add(r io.Reader) (string, error) {
+	return t.shell.Add(r)
+}
+
+// Cat returns the content with the given CID from IPFS
+func (t *IPFS) Cat(cid string) (io.ReadCloser, error) {
+	return t.shell.Cat(cid)
+}
+
+// DagPut stores the dag-json node on IPFS, which keeps it as dag-cbor, and returns its CID
+func (t *IPFS) DagPut(node []byte) (string, error) {
+	return t.shell.DagPut(node, "dag-json", "dag-cbor")
+}
+
+// DagGet returns the node with the given CID from IPFS as dag-json
+func (t *IPFS) DagGet(cid string) ([]byte, error) {
+	var node json.RawMessage
+	err := t.shell.DagGet(cid, &node)
+	return node, err
+}
+
+// Pin pins the CID on the IPFS daemon, recursively
+func (t *IPFS) Pin(cid string) error {
+	return t.shell.Pin(cid)
+}
+
+// Unpin removes the pin of the CID from the IPFS daemon
+func (t *IPFS) Unpin(cid string) error {
+	return t.shell.Unpin(cid)
+}
+
+// NamePublish points the IPNS name of the IPFS daemon, which is its peer ID, to the CID
+// Publishing a name can take a while, since the record is put in the DHT
+func (t *IPFS) NamePublish(cid string) (string, error) {
+	resp, err := t.shell.PublishWithDetails("/ipfs/"+cid, "", 0, 0, false)
+	if err != nil {
+		return "", err
+	}
+	return resp.Name, nil
+}
+
+// NameResolve looks up the CID the IPNS name points to
+func (t *IPFS) NameResolve(name string) (string, error) {
+	path, err := t.shell.Resolve(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path, "/ipfs/"), nil
+}
+
+// Publish sends data on the PubSub topic
+func (t *IPFS) Publish(topic, data string) error {
+	return t.shell.PubSubPublish(topic, data)
+}
+
+// Subscribe subscribes to the PubSub topic
+func (t *IPFS) Subscribe(topic string) (Subscription, error) {
+	sub, err := t.shell.PubSubSubscribe(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &ipfsSubscription{topic: topic, sub: sub}, nil
+}
+
+// ID returns the peer ID of the IPFS daemon
+func (t *IPFS) ID() (string, error) {
+	id, err := t.shell.ID()
+	if err != nil {
+		return "", err
+	}
+	return id.ID, nil
+}
+
+// ipfsSubscription wraps the PubSub subscription of go-ipfs-api
+type ipfsSubscription struct {
+	topic string
+	sub   *shell.PubSubSubscription
+}
+
+// Next waits for the next message on the topic
+func (s *ipfsSubscription) Next() (*Message, error) {
+	msg, err := s.sub.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{From: msg.From.String(), Topic: s.topic, Data: msg.Data}, nil
+}
+
+// Cancel stops the subscription
+func (s *ipfsSubscription) Cancel() error {
+	return s.sub.Cancel()
+}
@@ -0,0 +1,107 @@
+package transport_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"git.kiefte.eu/lapingvino/infodump/transport"
+	"git.kiefte.eu/lapingvino/infodump/transport/ipfstest"
+)
+
+// Test the IPFS transport against the fake IPFS API
+func TestIPFS(t *testing.T) {
+	server := ipfstest.NewServer()
+	defer server.Close()
+	ipfs := transport.NewIPFS(server.URL)
+
+	id, err := ipfs.ID()
+	if err != nil || id != ipfstest.PeerID {
+		t.Fatalf("expected ID %s, got %s %v", ipfstest.PeerID, id, err)
+	}
+
+	cid, err := ipfs.Add(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ipfs.Cat(cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("expected hello, got %q", data)
+	}
+	if _, err := ipfs.Cat("QmNothing"); err == nil {
+		t.Error("expected an error for unknown content")
+	}
+
+	node, err := ipfs.DagPut([]byte(`{"Messages":{"stamp":{"/":"QmMessage"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ipfs.DagGet(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"QmMessage"`) {
+		t.Errorf("expected the node to come back, got %s", data)
+	}
+
+	if err := ipfs.Pin(node); err != nil || !server.Pinned(node) {
+		t.Errorf("expected %s to be pinned, got %v", node, err)
+	}
+	if err := ipfs.Unpin(node); err != nil || server.Pinned(node) {
+		t.Errorf("expected %s to be unpinned, got %v", node, err)
+	}
+	if err := ipfs.Unpin(node); err == nil {
+		t.Error("expected an error for a CID that is not pinned")
+	}
+
+	name, err := ipfs.NamePublish(node)
+	if err != nil || name != ipfstest.PeerID {
+		t.Fatalf("expected the name %s, got %s %v", ipfstest.PeerID, name, err)
+	}
+	if resolved, err := ipfs.NameResolve(name); err != nil || resolved != node {
+		t.Errorf("expected %s to resolve to %s, got %s %v", name, node, resolved, err)
+	}
+	if _, err := ipfs.NameResolve("QmNobody"); err == nil {
+		t.Error("expected an error for an unknown name")
+	}
+
+	sub, err := ipfs.Subscribe("oln-#ipfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(time.Second, func() bool { return server.Subscribers("oln-#ipfs") > 0 }) {
+		t.Fatal("expected the subscription to oln-#ipfs to reach the IPFS daemon")
+	}
+	if err := ipfs.Publish("oln-#ipfs", cid); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != ipfstest.PeerID || msg.Topic != "oln-#ipfs" || string(msg.Data) != cid {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	sub.Cancel()
+	if _, err := sub.Next(); err == nil {
+		t.Error("expected an error after cancelling")
+	}
+}
+
+// eventually checks the condition until it holds, it returns false if it doesn't within the timeout
+func eventually(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,393 @@
+// Package ipfstest provides a stand-in for the HTTP API of an IPFS daemon, for tests that
+// want to use the real go-ipfs-api client without running IPFS
+//
+// It implements the calls Infodump makes: add, cat, dag/put, dag/get, pin/add, pin/rm, name/publish,
+// name/resolve, pubsub/pub, pubsub/sub and id, with the content, the nodes, the pins, the names and
+// the PubSub topics kept in memory
+// Nodes are kept as the dag-json they were put as, and their CIDs are made the same way as those of content
+package ipfstest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	mbase "github.com/multiformats/go-multibase"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// PeerID is the ID the server reports for its node
+const PeerID = "QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N"
+
+// Server is a fake IPFS daemon, use its URL as the IPFS gateway
+type Server struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	blocks map[string][]byte
+	names  map[string]string
+	pins   map[string]bool
+	subs   map[string]map[chan []byte]bool
+	calls  map[string]int
+	seqno  int
+	done   chan struct{}
+}
+
+// NewServer starts a fake IPFS daemon, call Close when done with it
+func NewServer() *Server {
+	s := &Server{
+		blocks: make(map[string][]byte),
+		names:  make(map[string]string),
+		pins:   make(map[string]bool),
+		subs:   make(map[string]map[chan []byte]bool),
+		calls:  make(map[string]int),
+		done:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/id", s.id)
+	mux.HandleFunc("/api/v0/add", s.add)
+	mux.HandleFunc("/api/v0/cat", s.cat)
+	mux.HandleFunc("/api/v0/dag/put", s.dagPut)
+	mux.HandleFunc("/api/v0/dag/get", s.dagGet)
+	mux.HandleFunc("/api/v0/pin/add", s.pinAdd)
+	mux.HandleFunc("/api/v0/pin/rm", s.pinRemove)
+	mux.HandleFunc("/api/v0/name/publish", s.namePublish)
+	mux.HandleFunc("/api/v0/name/resolve", s.nameResolve)
+	mux.HandleFunc("/api/v0/pubsub/pub", s.publish)
+	mux.HandleFunc("/api/v0/pubsub/sub", s.subscribe)
+	s.Server = httptest.NewServer(s.count(mux))
+	return s
+}
+
+// Close ends the open subscriptions and shuts the server down
+func (s *Server) Close() {
+	s.lock.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.lock.Unlock()
+	s.Server.Close()
+}
+
+// Calls returns how often a command of the API was called, e.g. "add" or "pubsub/pub"
+func (s *Server) Calls(command string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[command]
+}
+
+// Subscribers returns how many subscriptions there are on a topic,
+// tests use it to wait until a listener is ready
+func (s *Server) Subscribers(topic string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.subs[topic])
+}
+
+// Get returns the content with the given CID, if it was added
+func (s *Server) Get(cid string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.blocks[cid]
+	return data, ok
+}
+
+// Put adds content the way the add command does and returns its CID
+func (s *Server) Put(data []byte) string {
+	hash, _ := mh.Sum(data, mh.SHA2_256, -1)
+	cid := hash.B58String()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blocks[cid] = data
+	return cid
+}
+
+// Pinned checks if the CID is pinned
+func (s *Server) Pinned(cid string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pins[cid]
+}
+
+// SetName points an IPNS name to a CID, the name of the server itself is PeerID
+func (s *Server) SetName(name, cid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.names[name] = cid
+}
+
+// Publish sends data to the subscribers of a topic, the way the pubsub/pub command does
+func (s *Server) Publish(topic string, data []byte) {
+	encode := func(b []byte) string {
+		// Like IPFS, the fields are wrapped in multibase
+		return "u" + base64.RawURLEncoding.EncodeToString(b)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seqno++
+	record, _ := json.Marshal(map[string]interface{}{
+		"from":     PeerID,
+		"data":     encode(data),
+		"seqno":    encode([]byte(fmt.Sprint(s.seqno))),
+		"topicIDs": []string{encode([]byte(topic))},
+	})
+	for sub := range s.subs[topic] {
+		// Like PubSub, a subscriber that can't keep up misses messages
+		select {
+		case sub <- record:
+		default:
+		}
+	}
+}
+
+// count keeps track of the calls to the API
+func (s *Server) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.calls[strings.TrimPrefix(r.URL.Path, "/api/v0/")]++
+		s.lock.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fail answers with an error the way IPFS does
+func fail(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Message": fmt.Sprintf(format, args...),
+		"Code":    0,
+		"Type":    "error",
+	})
+}
+
+// reply answers with the value as JSON
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// arg returns the first argument of the command, the go-ipfs-api client sends them as "arg" in the query
+func arg(w http.ResponseWriter, r *http.Request) (string, bool) {
+	value := r.URL.Query().Get("arg")
+	if value == "" {
+		fail(w, http.StatusBadRequest, "argument is required")
+		return "", false
+	}
+	return value, true
+}
+
+// topicArg returns the topic argument, which is wrapped in multibase
+func topicArg(w http.ResponseWriter, r *http.Request) (string, bool) {
+	value, ok := arg(w, r)
+	if !ok {
+		return "", false
+	}
+	_, decoded, err := mbase.Decode(value)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "topic is not multibase encoded: %v", err)
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// file reads the content of the first file of the multipart body
+func file(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		fail(w, http.StatusBadRequest, "file argument is required: %v", err)
+		return nil, false
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		fail(w, http.StatusBadRequest, "file argument is required: %v", err)
+		return nil, false
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "reading file: %v", err)
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *Server) id(w http.ResponseWriter, r *http.Request) {
+	reply(w, map[string]interface{}{
+		"ID":              PeerID,
+		"Addresses":       []string{},
+		"AgentVersion":    "ipfstest",
+		"ProtocolVersion": "ipfs/0.1.0",
+	})
+}
+
+func (s *Server) add(w http.ResponseWriter, r *http.Request) {
+	data, ok := file(w, r)
+	if !ok {
+		return
+	}
+	cid := s.Put(data)
+	reply(w, map[string]string{"Name": cid, "Hash": cid, "Size": fmt.Sprint(len(data))})
+}
+
+func (s *Server) cat(w http.ResponseWriter, r *http.Request) {
+	path, ok := arg(w, r)
+	if !ok {
+		return
+	}
+	cid := strings.TrimPrefix(path, "/ipfs/")
+	data, found := s.Get(cid)
+	if !found {
+		fail(w, http.StatusInternalServerError, "%s not found", cid)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+func (s *Server) dagPut(w http.ResponseWriter, r *http.Request) {
+	data, ok := file(w, r)
+	if !ok {
+		return
+	}
+	if !json.Valid(data) {
+		fail(w, http.StatusBadRequest, "node is not valid dag-json")
+		return
+	}
+	reply(w, map[string]interface{}{"Cid": map[string]string{"/": s.Put(data)}})
+}
+
+func (s *Server) dagGet(w http.ResponseWriter, r *http.Request) {
+	cid, ok := arg(w, r)
+	if !ok {
+		return
+	}
+	data, found := s.Get(cid)
+	if !found {
+		fail(w, http.StatusInternalServerError, "%s not found", cid)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Server) pinAdd(w http.ResponseWriter, r *http.Request) {
+	path, ok := arg(w, r)
+	if !ok {
+		return
+	}
+	cid := strings.TrimPrefix(path, "/ipfs/")
+	s.lock.Lock()
+	_, found := s.blocks[cid]
+	if found {
+		s.pins[cid] = true
+	}
+	s.lock.Unlock()
+	if !found {
+		fail(w, http.StatusInternalServerError, "%s not found", cid)
+		return
+	}
+	reply(w, map[string][]string{"Pins": {cid}})
+}
+
+func (s *Server) pinRemove(w http.ResponseWriter, r *http.Request) {
+	path, ok := arg(w, r)
+	if !ok {
+		return
+	}
+	cid := strings.TrimPrefix(path, "/ipfs/")
+	s.lock.Lock()
+	pinned := s.pins[cid]
+	delete(s.pins, cid)
+	s.lock.Unlock()
+	if !pinned {
+		fail(w, http.StatusInternalServerError, "%s is not pinned", cid)
+		return
+	}
+	reply(w, map[string][]string{"Pins": {cid}})
+}
+
+func (s *Server) namePublish(w http.ResponseWriter, r *http.Request) {
+	path, ok := arg(w, r)
+	if !ok {
+		return
+	}
+	cid := strings.TrimPrefix(path, "/ipfs/")
+	s.SetName(PeerID, cid)
+	reply(w, map[string]string{"Name": PeerID, "Value": "/ipfs/" + cid})
+}
+
+func (s *Server) nameResolve(w http.ResponseWriter, r *http.Request) {
+	name, ok := arg(w, r)
+	if !ok {
+		return
+	}
+	name = strings.TrimPrefix(name, "/ipns/")
+	s.lock.Lock()
+	cid, found := s.names[name]
+	s.lock.Unlock()
+	if !found {
+		fail(w, http.StatusInternalServerError, "could not resolve name %s", name)
+		return
+	}
+	reply(w, map[string]string{"Path": "/ipfs/" + cid})
+}
+
+func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
+	topic, ok := topicArg(w, r)
+	if !ok {
+		return
+	}
+	data, ok := file(w, r)
+	if !ok {
+		return
+	}
+	s.Publish(topic, data)
+	w.WriteHeader(http.StatusOK)
+}
+
+// subscribe streams the messages on the topic as JSON records, until the client or the server goes away
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+	topic, ok := topicArg(w, r)
+	if !ok {
+		return
+	}
+	sub := make(chan []byte, 64)
+	s.lock.Lock()
+	if s.subs[topic] == nil {
+		s.subs[topic] = make(map[chan []byte]bool)
+	}
+	s.subs[topic][sub] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.subs[topic], sub)
+		s.lock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case record := <-sub:
+			w.Write(record)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
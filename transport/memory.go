@@ -0,0 +1,294 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrCancelled is returned by Next after a subscription is cancelled
+var ErrCancelled = errors.New("subscription cancelled")
+
+// Network is an in-memory content store and PubSub bus that is shared by Memory transports
+// It stands in for IPFS in tests, so several nodes can talk to each other within one process
+// Like on IPFS, content can only be read from a peer that has it, and a peer that read
+// something has it from then on
+// The network can be split into partitions that can't reach each other, and can delay everything it delivers
+type Network struct {
+	lock      sync.Mutex
+	blocks    map[string][]byte
+	providers map[string]map[string]bool
+	names     map[string]string
+	pins      map[string]map[string]bool
+	subs      map[string]map[*memorySubscription]bool
+	partition map[string]int
+	latency   time.Duration
+}
+
+// NewNetwork creates an empty in-memory network
+func NewNetwork() *Network {
+	return &Network{
+		blocks:    make(map[string][]byte),
+		providers: make(map[string]map[string]bool),
+		names:     make(map[string]string),
+		pins:      make(map[string]map[string]bool),
+		subs:      make(map[string]map[*memorySubscription]bool),
+		partition: make(map[string]int),
+	}
+}
+
+// SetLatency makes the network wait the given time before it delivers published messages or content
+func (n *Network) SetLatency(latency time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.latency = latency
+}
+
+// Partition splits the network, the peers in a group can only reach each other
+// Peers that are not in any of the groups together form one more group
+func (n *Network) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			n.partition[id] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions, so every peer can reach every other peer again
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Subscribers returns how many subscriptions there are on a topic,
+// tests use it to wait until the peers are listening
+func (n *Network) Subscribers(topic string) int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.subs[topic])
+}
+
+// Pinned checks if the peer pinned the CID
+func (n *Network) Pinned(id, cid string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.pins[id][cid]
+}
+
+// reachable checks if two peers are in the same partition, the lock must be held
+func (n *Network) reachable(a, b string) bool {
+	return n.partition[a] == n.partition[b]
+}
+
+// Node returns a Transport for the peer with the given ID on the network
+func (n *Network) Node(id string) *Memory {
+	return &Memory{network: n, id: id}
+}
+
+// Memory is a Transport for a single peer on an in-memory Network
+type Memory struct {
+	network *Network
+	id      string
+}
+
+// Add stores the content in the network and returns its CID, which is derived from the SHA256 hash of the content
+func (t *Memory) Add(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	cid := "mem" + hex.EncodeToString(hash[:])
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	t.network.blocks[cid] = data
+	t.network.provide(cid, t.id)
+	return cid, nil
+}
+
+// provide records that the peer has the content, the lock must be held
+func (n *Network) provide(cid, id string) {
+	if n.providers[cid] == nil {
+		n.providers[cid] = make(map[string]bool)
+	}
+	n.providers[cid][id] = true
+}
+
+// Cat returns the content with the given CID, if a peer in the same partition has it
+func (t *Memory) Cat(cid string) (io.ReadCloser, error) {
+	t.network.lock.Lock()
+	latency := t.network.latency
+	t.network.lock.Unlock()
+	time.Sleep(latency)
+
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	data, ok := t.network.blocks[cid]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", cid)
+	}
+	for id := range t.network.providers[cid] {
+		if t.network.reachable(t.id, id) {
+			t.network.provide(cid, t.id)
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not reachable", cid)
+}
+
+// DagPut stores the node like Add does, so nodes with the same content share their CID
+func (t *Memory) DagPut(node []byte) (string, error) {
+	return t.Add(bytes.NewReader(node))
+}
+
+// DagGet returns the node with the given CID, if a peer in the same partition has it
+func (t *Memory) DagGet(cid string) ([]byte, error) {
+	r, err := t.Cat(cid)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Pin gets the content with the CID like Cat does and pins it for the peer
+// Links are not followed, the nodes a node links to have to be pinned separately
+func (t *Memory) Pin(cid string) error {
+	r, err := t.Cat(cid)
+	if err != nil {
+		return err
+	}
+	r.Close()
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	if t.network.pins[t.id] == nil {
+		t.network.pins[t.id] = make(map[string]bool)
+	}
+	t.network.pins[t.id][cid] = true
+	return nil
+}
+
+// Unpin removes the pin of the CID for the peer
+func (t *Memory) Unpin(cid string) error {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	if !t.network.pins[t.id][cid] {
+		return fmt.Errorf("%s is not pinned", cid)
+	}
+	delete(t.network.pins[t.id], cid)
+	return nil
+}
+
+// NamePublish points the name of the peer, which is its ID, to the CID
+func (t *Memory) NamePublish(cid string) (string, error) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	t.network.names[t.id] = cid
+	return t.id, nil
+}
+
+// NameResolve returns the CID the name of a peer points to, if that peer is in the same partition
+func (t *Memory) NameResolve(name string) (string, error) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	cid, ok := t.network.names[name]
+	if !ok {
+		return "", fmt.Errorf("name %s not found", name)
+	}
+	if !t.network.reachable(t.id, name) {
+		return "", fmt.Errorf("name %s is not reachable", name)
+	}
+	return cid, nil
+}
+
+// Publish delivers data to every subscription on the topic that is in the same partition,
+// including the ones of the publishing peer
+func (t *Memory) Publish(topic, data string) error {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	msg := &Message{From: t.id, Topic: topic, Data: []byte(data)}
+	for sub := range t.network.subs[topic] {
+		if !t.network.reachable(t.id, sub.peer) {
+			continue
+		}
+		if t.network.latency > 0 {
+			time.AfterFunc(t.network.latency, func(sub *memorySubscription) func() {
+				return func() { sub.deliver(msg) }
+			}(sub))
+		} else {
+			sub.deliver(msg)
+		}
+	}
+	return nil
+}
+
+// Subscribe starts listening on a topic
+func (t *Memory) Subscribe(topic string) (Subscription, error) {
+	sub := &memorySubscription{network: t.network, topic: topic, peer: t.id}
+	sub.cond = sync.NewCond(&sub.lock)
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	if t.network.subs[topic] == nil {
+		t.network.subs[topic] = make(map[*memorySubscription]bool)
+	}
+	t.network.subs[topic][sub] = true
+	return sub, nil
+}
+
+// ID returns the ID the peer was created with
+func (t *Memory) ID() (string, error) {
+	return t.id, nil
+}
+
+// memorySubscription queues the messages for a subscriber, so publishing never blocks
+type memorySubscription struct {
+	network   *Network
+	topic     string
+	peer      string
+	lock      sync.Mutex
+	cond      *sync.Cond
+	queue     []*Message
+	cancelled bool
+}
+
+// deliver adds a message to the queue of the subscription
+func (s *memorySubscription) deliver(msg *Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queue = append(s.queue, msg)
+	s.cond.Signal()
+}
+
+// Next waits for the next message on the topic
+func (s *memorySubscription) Next() (*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.queue) == 0 && !s.cancelled {
+		s.cond.Wait()
+	}
+	if s.cancelled {
+		return nil, ErrCancelled
+	}
+	msg := s.queue[0]
+	s.queue = s.queue[1:]
+	return msg, nil
+}
+
+// Cancel stops the subscription
+func (s *memorySubscription) Cancel() error {
+	s.network.lock.Lock()
+	delete(s.network.subs[s.topic], s)
+	s.network.lock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancelled = true
+	s.cond.Broadcast()
+	return nil
+}
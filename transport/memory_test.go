@@ -0,0 +1,97 @@
+package transport_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"git.kiefte.eu/lapingvino/infodump/transport"
+)
+
+// Test that content added by one node can be read by another
+func TestMemoryAddCat(t *testing.T) {
+	network := transport.NewNetwork()
+	a, b := network.Node("a"), network.Node("b")
+	cid, err := a.Add(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Cat(cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, _ := io.ReadAll(r)
+	if string(data) != "hello" {
+		t.Errorf("expected hello, got %q", data)
+	}
+	if _, err := b.Cat("nothing"); err == nil {
+		t.Error("expected an error for unknown content")
+	}
+}
+
+// Test that published messages reach the subscribers of the topic, and nothing after cancelling
+func TestMemoryPubSub(t *testing.T) {
+	network := transport.NewNetwork()
+	a, b := network.Node("a"), network.Node("b")
+	sub, err := b.Subscribe("OLN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Publish("other", "ignored")
+	a.Publish("OLN", "cid")
+	msg, err := sub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != "a" || msg.Topic != "OLN" || string(msg.Data) != "cid" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	sub.Cancel()
+	if _, err := sub.Next(); err != transport.ErrCancelled {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+}
+
+// Test that content and messages don't cross a partition, and do again after healing
+func TestMemoryPartition(t *testing.T) {
+	network := transport.NewNetwork()
+	a, b := network.Node("a"), network.Node("b")
+	network.Partition([]string{"a"})
+	cid, _ := a.Add(strings.NewReader("hello"))
+	if _, err := b.Cat(cid); err == nil {
+		t.Error("expected the content not to be reachable across the partition")
+	}
+	sub, _ := b.Subscribe("OLN")
+	a.Publish("OLN", "lost")
+	network.Heal()
+	a.Publish("OLN", "found")
+	msg, err := sub.Next()
+	if err != nil || string(msg.Data) != "found" {
+		t.Errorf("expected only the message after healing, got %v %v", msg, err)
+	}
+	if _, err := b.Cat(cid); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that a name resolves to what the peer published last, as long as the peer can be reached
+func TestMemoryNames(t *testing.T) {
+	network := transport.NewNetwork()
+	a, b := network.Node("a"), network.Node("b")
+	if _, err := b.NameResolve("a"); err == nil {
+		t.Error("expected an error before a published its name")
+	}
+	for _, cid := range []string{"first", "second"} {
+		if name, err := a.NamePublish(cid); err != nil || name != "a" {
+			t.Fatalf("expected the name a, got %s %v", name, err)
+		}
+	}
+	if cid, err := b.NameResolve("a"); err != nil || cid != "second" {
+		t.Errorf("expected a to resolve to second, got %s %v", cid, err)
+	}
+	network.Partition([]string{"a"}, []string{"b"})
+	if _, err := b.NameResolve("a"); err == nil {
+		t.Error("expected an error across partitions")
+	}
+}
@@ -0,0 +1,48 @@
+// Package transport decouples Infodump from the way it talks to the network
+// The IPFS implementation talks to an IPFS daemon over its HTTP API,
+// the Memory implementation keeps everything in the process, for tests and simulations
+package transport
+
+import "io"
+
+// Transport is everything Infodump needs from the network:
+// storing, retrieving and pinning content and IPLD nodes by CID, IPNS names, and PubSub to tell others about it
+type Transport interface {
+	// Add stores the content and returns its CID
+	Add(r io.Reader) (string, error)
+	// Cat returns the content with the given CID
+	Cat(cid string) (io.ReadCloser, error)
+	// DagPut stores a dag-json node and returns its CID, links to other nodes are written as {"/": "<cid>"}
+	DagPut(node []byte) (string, error)
+	// DagGet returns the node with the given CID as dag-json
+	DagGet(cid string) ([]byte, error)
+	// Pin keeps the content or node with the CID, and everything it links to, on the node
+	Pin(cid string) error
+	// Unpin lets the node remove the content with the CID again when it needs the space
+	Unpin(cid string) error
+	// NamePublish points the IPNS name of the node to the CID and returns the name
+	NamePublish(cid string) (string, error)
+	// NameResolve returns the CID an IPNS name points to
+	NameResolve(name string) (string, error)
+	// Publish sends data to everyone subscribed to the topic
+	Publish(topic, data string) error
+	// Subscribe starts listening on a topic
+	Subscribe(topic string) (Subscription, error)
+	// ID returns the peer ID of the node, it also serves to check if the node can be reached
+	ID() (string, error)
+}
+
+// Subscription is a PubSub subscription to a topic
+type Subscription interface {
+	// Next waits for the next message on the topic
+	Next() (*Message, error)
+	// Cancel stops the subscription, Next returns an error after it
+	Cancel() error
+}
+
+// Message is a PubSub message
+type Message struct {
+	From  string
+	Topic string
+	Data  []byte
+}